@@ -1,65 +1,302 @@
 package main
 
 import (
+	"context"
 	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
 	"github.com/google/uuid"
 )
 
-var _ webpush.Subscriber = (*Agent)(nil)
+var _ webpush.AuthenticatingSubscriber = (*Agent)(nil)
+var _ webpush.ExpiringSubscriber = (*Agent)(nil)
 var _ webpush.Pusher = (*Agent)(nil)
 
+// ErrNotOwner is returned when revoking a subscription without proving
+// ownership of it.
+var ErrNotOwner = errors.New("not the owner of the subscription")
+
+// sinkTimeout is the time a sink has to deliver a message.
+const sinkTimeout = 30 * time.Second
+
+// Agent is a stateless push service. Everything required to handle push
+// messages is held in the sealed token of each push endpoint.
 type Agent struct {
-	Secret       []byte
+	// Keyring holds the secrets tokens are sealed with.
+	Keyring      *Keyring
 	PushEndpoint string
-	Manager      *webpush.PushManager
+	// TokenLifetime is the time subscriptions are valid for. Zero means that
+	// subscriptions never expire.
+	TokenLifetime time.Duration
+	// Revocations holds revoked subscriptions.
+	Revocations *RevocationList
+	// Client is used to deliver messages to sinks. Defaults to
+	// [http.DefaultClient].
+	Client *http.Client
+	// CommandDirectory holds the commands exec sinks may run. Exec sinks are
+	// disabled if empty.
+	CommandDirectory string
+	// SpoolDirectory is the directory file sinks write messages to. File sinks
+	// are disabled if empty.
+	SpoolDirectory string
+	// Sinks holds the sinks subscriptions may use, keyed by name.
+	Sinks map[string]*SinkConfig
 }
 
-// Subscribe implements webpush.PushService.
+// NewSubscription creates a subscription for an application server, whose
+// messages are delivered to the sink named sink, one of [Agent.Sinks].
+// Messages are written to stdout if sink is empty.
+// Unlike subscriptions created using [webpush.PushManager], the subscription
+// is not stored anywhere.
+func (a *Agent) NewSubscription(applicationServerPublicKey *ecdh.PublicKey, sink string) (*webpush.Subscription, error) {
+	if _, ok := a.Sinks[sink]; sink != "" && !ok {
+		return nil, fmt.Errorf("unknown sink %q", sink)
+	}
+
+	userAgentPrivateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticationSecret := make([]byte, 16)
+	if _, err := rand.Read(authenticationSecret); err != nil {
+		return nil, err
+	}
+
+	token, endpoint, err := a.subscribe(userAgentPrivateKey, applicationServerPublicKey, authenticationSecret, sink)
+	if err != nil {
+		return nil, err
+	}
+
+	subscription := &webpush.Subscription{
+		ID:       token.SubscriptionID.String(),
+		Endpoint: endpoint,
+		Keys: webpush.SubscriptionKeys{
+			Auth:   base64.RawURLEncoding.EncodeToString(authenticationSecret),
+			P256DH: base64.RawURLEncoding.EncodeToString(userAgentPrivateKey.PublicKey().Bytes()),
+		},
+	}
+
+	if !token.ExpiresAt.IsZero() {
+		subscription.ExpirationTime = &token.ExpiresAt
+	}
+
+	return subscription, nil
+}
+
+// Subscribe implements webpush.Subscriber.
+// The agent needs the authentication secret to decrypt messages, use
+// [Agent.SubscribeWithAuthenticationSecret].
 func (a *Agent) Subscribe(userAgentPrivateKey *ecdh.PrivateKey, applicationServerPublicKey *ecdh.PublicKey) (string, string, error) {
-	subscriptionID, err := uuid.NewRandom()
+	return "", "", errors.New("authentication secret required")
+}
+
+// SubscribeWithAuthenticationSecret implements
+// webpush.AuthenticatingSubscriber.
+// Messages are written to stdout, use [Agent.NewSubscription] to configure a
+// sink.
+func (a *Agent) SubscribeWithAuthenticationSecret(userAgentPrivateKey *ecdh.PrivateKey, applicationServerPublicKey *ecdh.PublicKey, authenticationSecret []byte) (string, string, error) {
+	token, endpoint, err := a.subscribe(userAgentPrivateKey, applicationServerPublicKey, authenticationSecret, "")
 	if err != nil {
 		return "", "", err
 	}
 
+	return token.SubscriptionID.String(), endpoint, nil
+}
+
+// subscribe creates and seals a token, returning it and its push endpoint.
+func (a *Agent) subscribe(userAgentPrivateKey *ecdh.PrivateKey, applicationServerPublicKey *ecdh.PublicKey, authenticationSecret []byte, sink string) (*Token, string, error) {
+	// The subscription ID holds the time it was created, see
+	// [Agent.ExpirationTime]
+	subscriptionID, err := uuid.NewV7()
+	if err != nil {
+		return nil, "", err
+	}
+
+	createdAt := subscriptionCreatedAt(subscriptionID)
+
 	token := Token{
-		Version:                    1,
+		Version:                    TokenVersion3,
 		SubscriptionID:             subscriptionID,
+		CreatedAt:                  createdAt,
 		ApplicationServerPublicKey: applicationServerPublicKey,
 		UserAgentPrivateKey:        userAgentPrivateKey,
+		AuthenticationSecret:       authenticationSecret,
+		Sink:                       sink,
 	}
 
-	sealedToken, err := token.SealString(a.Secret)
+	if a.TokenLifetime > 0 {
+		token.ExpiresAt = a.expiresAt(createdAt)
+	}
+
+	sealedToken, err := a.Keyring.Seal(&token)
 	if err != nil {
-		return "", "", err
+		return nil, "", err
+	}
+
+	return &token, a.PushEndpoint + "/" + sealedToken, nil
+}
+
+// ExpirationTime implements webpush.ExpiringSubscriber.
+// As the agent keeps no state, the expiration time is derived from the time
+// held by the subscription ID, a version 7 UUID, and the current token
+// lifetime.
+// NOTE: The subscription ID is part of the push endpoint, exposing the time
+// the subscription was created. The expiry itself remains encrypted.
+func (a *Agent) ExpirationTime(subscriptionID string) (*time.Time, error) {
+	id, err := uuid.Parse(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if id.Version() != 7 {
+		return nil, errors.New("subscription ID holds no creation time")
+	}
+
+	if a.TokenLifetime <= 0 {
+		return nil, nil
+	}
+
+	expiresAt := a.expiresAt(subscriptionCreatedAt(id))
+	return &expiresAt, nil
+}
+
+// expiresAt returns the time a token created at createdAt expires, truncated
+// to seconds like the time held by tokens.
+func (a *Agent) expiresAt(createdAt time.Time) time.Time {
+	return fromUnixSeconds(createdAt.Add(a.TokenLifetime).Unix())
+}
+
+// subscriptionCreatedAt returns the time held by a version 7 UUID.
+func subscriptionCreatedAt(subscriptionID uuid.UUID) time.Time {
+	seconds, nanoseconds := subscriptionID.Time().UnixTime()
+	return time.Unix(seconds, nanoseconds).UTC()
+}
+
+// Unsubscribe implements webpush.Subscriber.
+// As tokens are stateless, the subscription is revoked rather than removed.
+// The revocation is kept until the subscription expires, derived like
+// [Agent.ExpirationTime].
+func (a *Agent) Unsubscribe(subscriptionID string) error {
+	id, err := uuid.Parse(subscriptionID)
+	if err != nil {
+		return err
+	}
+
+	// Keep revocations of subscriptions without a known expiry forever
+	var expiresAt time.Time
+	if expirationTime, err := a.ExpirationTime(subscriptionID); err == nil && expirationTime != nil {
+		expiresAt = *expirationTime
 	}
 
-	return subscriptionID.String(), a.PushEndpoint + "/" + sealedToken, nil
+	return a.Revocations.Revoke(id, expiresAt)
+}
+
+// Revoke revokes the subscription of a push endpoint's token on behalf of its
+// subscriber. As the subscription ID is visible in push endpoints, the
+// subscription's authentication secret is required to prove ownership.
+func (a *Agent) Revoke(sealedToken string, authenticationSecret []byte) error {
+	token, err := a.Keyring.Open(sealedToken)
+	if err != nil {
+		return fmt.Errorf("%w: %w", webpush.ErrSubscriptionNotFound, err)
+	}
+
+	// Version 1 tokens lack an authentication secret and can't be revoked
+	if len(token.AuthenticationSecret) == 0 || subtle.ConstantTimeCompare(token.AuthenticationSecret, authenticationSecret) != 1 {
+		return ErrNotOwner
+	}
+
+	return a.Revocations.Revoke(token.SubscriptionID, token.ExpiresAt)
 }
 
 // Push implements webpush.Pusher.
 func (a *Agent) Push(request *webpush.PushRequest) error {
-	var token Token
-	if err := token.OpenString(request.Token, a.Secret); err != nil {
-		return err
+	// Tokens that can't be opened, such as garbage or tokens sealed using a
+	// removed secret, belong to no subscription
+	token, err := a.Keyring.Open(request.Token)
+	if err != nil {
+		return fmt.Errorf("%w: %w", webpush.ErrSubscriptionNotFound, err)
+	}
+
+	// Version 1 tokens lack the authentication secret required to decrypt
+	// messages
+	if token.Version < TokenVersion2 {
+		return fmt.Errorf("%w: unsupported token version", webpush.ErrSubscriptionNotFound)
+	}
+
+	if token.Expired(time.Now()) {
+		return fmt.Errorf("%w: subscription has expired", webpush.ErrSubscriptionNotFound)
+	}
+
+	// Let application servers know to drop revoked subscriptions
+	// SEE: https://datatracker.ietf.org/doc/html/rfc8030#section-7.3
+	if a.Revocations.Revoked(token.SubscriptionID) {
+		return fmt.Errorf("%w: subscription is revoked", webpush.ErrSubscriptionNotFound)
 	}
 
 	// TODO: Validate authentication, public key, vapid
 
-	// NOTE: In our case we don't really care about the rest of the fields...
-	// TODO: Again, this interface isn't really that nice for our stateless use
-	// case. In practice we have the state in the token above
-	plaintext, err := a.Manager.HandleMessage(token.SubscriptionID.String(), request.Content)
+	if len(request.Content) == 0 {
+		fmt.Println("Received empty message")
+		return nil
+	}
+
+	plaintext, err := webpush.DecryptMessage(token.UserAgentPrivateKey, token.AuthenticationSecret, request.Content)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", webpush.ErrDecryptionFailed, err)
+	}
+
+	return a.deliver(token, &Message{
+		SubscriptionID: token.SubscriptionID,
+		Topic:          request.Topic,
+		Urgency:        request.Urgency,
+		ContentType:    request.ContentType,
+		Content:        plaintext,
+	})
+}
+
+// deliver delivers a message to the sink named in token, or writes it to
+// stdout if there is none.
+func (a *Agent) deliver(token *Token, message *Message) error {
+	if token.Sink == "" {
+		fmt.Println("Received message")
+		fmt.Printf("%s\n", message.Content)
+		return nil
 	}
 
-	// In practice, this message would likely be sent to some other service like
-	// Gotify
-	fmt.Println("Received message")
-	fmt.Printf("%s\n", plaintext)
+	// The sink may have been removed by the operator since the subscription
+	// was created
+	config, ok := a.Sinks[token.Sink]
+	if !ok {
+		return fmt.Errorf("%w: unknown sink %q", webpush.ErrDeliveryFailed, token.Sink)
+	}
+
+	sink, err := config.Sink()
+	if err != nil {
+		return fmt.Errorf("invalid sink configuration: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+	defer cancel()
+
+	if err := sink.Deliver(ctx, a, message); err != nil {
+		return fmt.Errorf("%w: %w", webpush.ErrDeliveryFailed, err)
+	}
 
 	return nil
 }
+
+// httpClient returns the client used to deliver messages to sinks.
+func (a *Agent) httpClient() *http.Client {
+	if a.Client == nil {
+		return http.DefaultClient
+	}
+	return a.Client
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentPush(t *testing.T) {
+	testCases := []struct {
+		Name          string
+		TokenLifetime time.Duration
+		Revoke        bool
+		ExpectedError string
+	}{
+		{
+			Name: "No expiry",
+		},
+		{
+			Name:          "Valid",
+			TokenLifetime: time.Hour,
+		},
+		{
+			Name: "Expired",
+			// Expiry times are truncated to seconds, expiring the token immediately
+			TokenLifetime: time.Nanosecond,
+			ExpectedError: "410",
+		},
+		{
+			Name:          "Revoked",
+			Revoke:        true,
+			ExpectedError: "410",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			keyring, err := NewKeyring(0, make([]byte, 32))
+			require.NoError(t, err)
+
+			agent := &Agent{
+				Keyring:       keyring,
+				Revocations:   NewRevocationList(),
+				TokenLifetime: testCase.TokenLifetime,
+			}
+
+			server := httptest.NewServer(webpush.NewPushServer(agent))
+			defer server.Close()
+			agent.PushEndpoint = server.URL + "/push"
+
+			applicationServer, err := webpush.NewApplicationServer()
+			require.NoError(t, err)
+
+			// A fresh push manager with no state, the agent relies on the token alone
+			subscription, err := webpush.NewPushManager(agent, webpush.NewMemorySubscriptionStore()).Subscribe(applicationServer.PublicECDH())
+			require.NoError(t, err)
+
+			if testCase.Revoke {
+				require.NoError(t, agent.Unsubscribe(subscription.ID))
+			}
+
+			target, err := subscription.PushTarget()
+			require.NoError(t, err)
+
+			err = applicationServer.Push(context.TODO(), target, []byte("Hello, World!"), &webpush.PushOptions{TTL: 60})
+			if testCase.ExpectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, testCase.ExpectedError)
+			}
+		})
+	}
+}
+
+func TestAgentPushGotify(t *testing.T) {
+	gotify, messages := newTestGotify(t, "token")
+
+	keyring, err := NewKeyring(0, make([]byte, 32))
+	require.NoError(t, err)
+
+	agent := &Agent{
+		Keyring:     keyring,
+		Revocations: NewRevocationList(),
+	}
+
+	server := httptest.NewServer(webpush.NewPushServer(agent))
+	defer server.Close()
+	agent.PushEndpoint = server.URL + "/push"
+
+	applicationServer, err := webpush.NewApplicationServer()
+	require.NoError(t, err)
+
+	agent.Sinks = map[string]*SinkConfig{
+		"gotify": {Gotify: &GotifySink{URL: gotify.URL, Token: "token"}},
+	}
+
+	_, err = agent.NewSubscription(applicationServer.PublicECDH(), "unknown")
+	assert.Error(t, err)
+
+	subscription, err := agent.NewSubscription(applicationServer.PublicECDH(), "gotify")
+	require.NoError(t, err)
+
+	target, err := subscription.PushTarget()
+	require.NoError(t, err)
+
+	notification := webpush.DeclerativePushNotification{
+		Title:    "Hello",
+		Body:     "World",
+		Navigate: "https://example.com",
+	}
+
+	err = applicationServer.PushNotification(context.TODO(), target, notification, &webpush.PushOptions{TTL: 60, Urgency: webpush.UrgencyHigh})
+	require.NoError(t, err)
+
+	message := <-messages
+	assert.Equal(t, "Hello", message["title"])
+	assert.Equal(t, "World", message["message"])
+	assert.Equal(t, float64(8), message["priority"])
+
+	// Failing to deliver a message fails the push, letting the application
+	// server retry
+	gotify.Close()
+	err = applicationServer.Push(context.TODO(), target, []byte("Hello, World!"), &webpush.PushOptions{TTL: 60})
+	assert.ErrorContains(t, err, "503")
+	// Sinks are resolved by name when delivering, failing once removed
+	delete(agent.Sinks, "gotify")
+	err = applicationServer.Push(context.TODO(), target, []byte("Hello, World!"), &webpush.PushOptions{TTL: 60})
+	assert.ErrorContains(t, err, "503")
+}
+
+func TestAgentExpirationTime(t *testing.T) {
+	keyring, err := NewKeyring(0, make([]byte, 32))
+	require.NoError(t, err)
+
+	agent := &Agent{
+		Keyring:       keyring,
+		Revocations:   NewRevocationList(),
+		TokenLifetime: time.Hour,
+	}
+
+	server := httptest.NewServer(webpush.NewPushServer(agent))
+	defer server.Close()
+	agent.PushEndpoint = server.URL + "/push"
+
+	applicationServer, err := webpush.NewApplicationServer()
+	require.NoError(t, err)
+
+	pushManager := webpush.NewPushManager(agent, webpush.NewMemorySubscriptionStore())
+	// Renew subscriptions immediately
+	pushManager.RenewBefore = 2 * time.Hour
+
+	subscription, err := pushManager.Subscribe(applicationServer.PublicECDH())
+	require.NoError(t, err)
+
+	// The expiration time is that of the token
+	require.NotNil(t, subscription.ExpirationTime)
+	token, err := keyring.Open(subscription.Endpoint[strings.LastIndex(subscription.Endpoint, "/")+1:])
+	require.NoError(t, err)
+	assert.Equal(t, token.ExpiresAt, *subscription.ExpirationTime)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *subscription.ExpirationTime, 2*time.Second)
+
+	// Expiring subscriptions are renewed
+	changes := make(chan webpush.SubscriptionChange, 1)
+	pushManager.OnSubscriptionChange(func(change webpush.SubscriptionChange) {
+		select {
+		case changes <- change:
+		default:
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go pushManager.Run(ctx)
+
+	select {
+	case change := <-changes:
+		assert.Equal(t, subscription.ID, change.Old.ID)
+		assert.NotEqual(t, subscription.Endpoint, change.New.Endpoint)
+	case <-ctx.Done():
+		require.FailNow(t, "timed out waiting for renewal")
+	}
+
+	// The renewed subscription is revoked
+	target, err := subscription.PushTarget()
+	require.NoError(t, err)
+	err = applicationServer.Push(context.TODO(), target, []byte("Hello, World!"), &webpush.PushOptions{TTL: 60})
+	assert.ErrorContains(t, err, "410")
+
+	// Subscriptions never expire without a token lifetime
+	agent.TokenLifetime = 0
+	expirationTime, err := agent.ExpirationTime(subscription.ID)
+	require.NoError(t, err)
+	assert.Nil(t, expirationTime)
+
+	_, err = agent.ExpirationTime(uuid.NewString())
+	assert.Error(t, err)
+}
+
+func TestAgentRevoke(t *testing.T) {
+	keyring, err := NewKeyring(0, make([]byte, 32))
+	require.NoError(t, err)
+
+	agent := &Agent{
+		Keyring:       keyring,
+		Revocations:   NewRevocationList(),
+		PushEndpoint:  "http://localhost:8082/push",
+		TokenLifetime: time.Hour,
+	}
+
+	applicationServer, err := webpush.NewApplicationServer()
+	require.NoError(t, err)
+
+	subscription, err := agent.NewSubscription(applicationServer.PublicECDH(), "")
+	require.NoError(t, err)
+
+	sealedToken := subscription.Endpoint[strings.LastIndex(subscription.Endpoint, "/")+1:]
+	authenticationSecret, err := subscription.Keys.AuthenticationSecret()
+	require.NoError(t, err)
+
+	// The subscription ID alone doesn't prove ownership
+	err = agent.Revoke(sealedToken, nil)
+	assert.ErrorIs(t, err, ErrNotOwner)
+	err = agent.Revoke(sealedToken, make([]byte, 16))
+	assert.ErrorIs(t, err, ErrNotOwner)
+
+	err = agent.Revoke("garbage", authenticationSecret)
+	assert.ErrorIs(t, err, webpush.ErrSubscriptionNotFound)
+
+	id := uuid.MustParse(subscription.ID)
+	assert.False(t, agent.Revocations.Revoked(id))
+	require.NoError(t, agent.Revoke(sealedToken, authenticationSecret))
+	assert.True(t, agent.Revocations.Revoked(id))
+
+	// The revocation is kept until the subscription expires
+	require.NoError(t, agent.Revocations.Prune(subscription.ExpirationTime.Add(-time.Second)))
+	assert.True(t, agent.Revocations.Revoked(id))
+	require.NoError(t, agent.Revocations.Prune(*subscription.ExpirationTime))
+	assert.False(t, agent.Revocations.Revoked(id))
+}
+
+func TestAgentPushInvalid(t *testing.T) {
+	keyring, err := NewKeyring(0, make([]byte, 32))
+	require.NoError(t, err)
+
+	agent := &Agent{
+		Keyring:     keyring,
+		Revocations: NewRevocationList(),
+	}
+
+	server := httptest.NewServer(webpush.NewPushServer(agent))
+	defer server.Close()
+	agent.PushEndpoint = server.URL + "/push"
+
+	applicationServer, err := webpush.NewApplicationServer()
+	require.NoError(t, err)
+
+	subscription, err := agent.NewSubscription(applicationServer.PublicECDH(), "")
+	require.NoError(t, err)
+
+	sealedToken := subscription.Endpoint[strings.LastIndex(subscription.Endpoint, "/")+1:]
+	ciphertext, err := base64.RawURLEncoding.DecodeString(sealedToken)
+	require.NoError(t, err)
+	// Key ID
+	ciphertext[1] = 9
+
+	testCases := []struct {
+		Name  string
+		Token string
+	}{
+		{Name: "Garbage", Token: "garbage"},
+		{Name: "Unknown key ID", Token: base64.RawURLEncoding.EncodeToString(ciphertext)},
+		{Name: "Truncated", Token: sealedToken[:10]},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodPost, agent.PushEndpoint+"/"+testCase.Token, nil)
+			require.NoError(t, err)
+			request.Header.Set("TTL", "60")
+
+			response, err := http.DefaultClient.Do(request)
+			require.NoError(t, err)
+			response.Body.Close()
+
+			// Let application servers know to drop the subscription
+			assert.Equal(t, http.StatusGone, response.StatusCode)
+		})
+	}
+
+	t.Run("Wrong keys", func(t *testing.T) {
+		// Encrypt the message using another authentication secret
+		subscription.Keys.Auth = base64.RawURLEncoding.EncodeToString(make([]byte, 16))
+		target, err := subscription.PushTarget()
+		require.NoError(t, err)
+
+		err = applicationServer.Push(context.TODO(), target, []byte("Hello, World!"), &webpush.PushOptions{TTL: 60})
+		assert.ErrorContains(t, err, "400")
+	})
+}
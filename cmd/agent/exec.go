@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var _ Sink = (*ExecSink)(nil)
+
+// ExecSink delivers messages to a command, writing the content to its stdin.
+// Metadata is passed using the environment variables PUSH_SUBSCRIPTION_ID,
+// PUSH_TOPIC, PUSH_URGENCY and PUSH_CONTENT_TYPE.
+// Only commands in the agent's command directory may be run.
+type ExecSink struct {
+	// Command is the name of an executable in [Agent.CommandDirectory].
+	Command string `json:"command"`
+	// Args holds optional arguments for the command.
+	Args []string `json:"args,omitempty"`
+}
+
+// Validate implements Sink.
+func (s *ExecSink) Validate(agent *Agent) error {
+	if agent.CommandDirectory == "" {
+		return errors.New("exec: no command directory configured")
+	}
+
+	// Disallow paths, only names within the command directory are allowed
+	if s.Command == "" || s.Command != filepath.Base(s.Command) || s.Command == "." || s.Command == ".." {
+		return errors.New("exec: command must be the name of a command in the command directory")
+	}
+
+	info, err := os.Stat(filepath.Join(agent.CommandDirectory, s.Command))
+	if err != nil || !info.Mode().IsRegular() {
+		return fmt.Errorf("exec: unknown command %q", s.Command)
+	}
+
+	return nil
+}
+
+// Deliver implements Sink.
+// The command's exit code must be zero.
+func (s *ExecSink) Deliver(ctx context.Context, agent *Agent, message *Message) error {
+	// The command directory may have changed since the subscription was created
+	if err := s.Validate(agent); err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, filepath.Join(agent.CommandDirectory, s.Command), s.Args...)
+	cmd.Stdin = bytes.NewReader(message.Content)
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(),
+		"PUSH_SUBSCRIPTION_ID="+message.SubscriptionID.String(),
+		"PUSH_TOPIC="+message.Topic,
+		"PUSH_URGENCY="+string(message.Urgency),
+		"PUSH_CONTENT_TYPE="+message.ContentType,
+	)
+
+	if err := cmd.Run(); err != nil {
+		if output := strings.TrimSpace(stderr.String()); output != "" {
+			return fmt.Errorf("exec: %w: %s", err, output)
+		}
+		return fmt.Errorf("exec: %w", err)
+	}
+
+	return nil
+}
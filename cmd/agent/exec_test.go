@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecSinkDeliver(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+
+	directory := t.TempDir()
+	output := filepath.Join(t.TempDir(), "output")
+
+	script := "#!/bin/sh\nset -e\n{ echo \"$1 $PUSH_SUBSCRIPTION_ID $PUSH_URGENCY\"; cat; } > \"$OUTPUT\"\n"
+	require.NoError(t, os.WriteFile(filepath.Join(directory, "notify"), []byte(script), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(directory, "fail"), []byte("#!/bin/sh\necho failed >&2\nexit 1\n"), 0o700))
+	t.Setenv("OUTPUT", output)
+
+	agent := &Agent{CommandDirectory: directory}
+
+	sink := &ExecSink{Command: "notify", Args: []string{"arg"}}
+	require.NoError(t, sink.Validate(agent))
+
+	message := &Message{
+		SubscriptionID: uuid.MustParse("5b9f2c4e-7e0a-4c36-9a55-3b8f0f0e8a1d"),
+		Urgency:        webpush.UrgencyHigh,
+		Content:        []byte("Hello, World!"),
+	}
+
+	require.NoError(t, sink.Deliver(context.TODO(), agent, message))
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "arg 5b9f2c4e-7e0a-4c36-9a55-3b8f0f0e8a1d high\nHello, World!", string(content))
+
+	// Failing commands fail delivery
+	err = (&ExecSink{Command: "fail"}).Deliver(context.TODO(), agent, message)
+	assert.ErrorContains(t, err, "failed")
+}
+
+func TestExecSinkValidate(t *testing.T) {
+	directory := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(directory, "notify"), nil, 0o700))
+	require.NoError(t, os.Mkdir(filepath.Join(directory, "subdirectory"), 0o700))
+
+	testCases := []struct {
+		Name    string
+		Command string
+		Err     bool
+	}{
+		{Name: "Valid", Command: "notify"},
+		{Name: "Empty", Command: "", Err: true},
+		{Name: "Unknown", Command: "unknown", Err: true},
+		{Name: "Directory", Command: "subdirectory", Err: true},
+		{Name: "Path", Command: "subdirectory/notify", Err: true},
+		{Name: "Absolute path", Command: "/bin/sh", Err: true},
+		{Name: "Parent", Command: "..", Err: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			err := (&ExecSink{Command: testCase.Command}).Validate(&Agent{CommandDirectory: directory})
+			if testCase.Err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	// Exec sinks are disabled without a command directory
+	assert.Error(t, (&ExecSink{Command: "notify"}).Validate(&Agent{}))
+}
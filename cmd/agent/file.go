@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var _ Sink = (*FileSink)(nil)
+
+// FileSink delivers messages to a spool directory, writing the JSON encoding
+// of each [Message] to a file of its own. Files are named so that they sort in
+// the order they were written.
+// Files are only written within the agent's spool directory.
+type FileSink struct {
+	// Directory is an optional directory, relative to [Agent.SpoolDirectory],
+	// to write messages to.
+	Directory string `json:"directory,omitempty"`
+}
+
+// Validate implements Sink.
+func (s *FileSink) Validate(agent *Agent) error {
+	if agent.SpoolDirectory == "" {
+		return errors.New("file: no spool directory configured")
+	}
+
+	if s.Directory != "" && !filepath.IsLocal(s.Directory) {
+		return errors.New("file: directory must be within the spool directory")
+	}
+
+	return nil
+}
+
+// Deliver implements Sink.
+// Messages are first written to a temporary file, which is then renamed,
+// making sure that readers never see partially written messages.
+func (s *FileSink) Deliver(ctx context.Context, agent *Agent, message *Message) error {
+	if err := s.Validate(agent); err != nil {
+		return err
+	}
+
+	directory := filepath.Join(agent.SpoolDirectory, s.Directory)
+	if err := os.MkdirAll(directory, 0o700); err != nil {
+		return fmt.Errorf("file: %w", err)
+	}
+
+	content, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	// Temporary files are hidden, readers should ignore them
+	file, err := os.CreateTemp(directory, ".message-*")
+	if err != nil {
+		return fmt.Errorf("file: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return fmt.Errorf("file: %w", err)
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("file: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("file: %w", err)
+	}
+
+	name := fmt.Sprintf("%d-%s.json", time.Now().UnixNano(), uuid.NewString())
+	if err := os.Rename(file.Name(), filepath.Join(directory, name)); err != nil {
+		return fmt.Errorf("file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSinkDeliver(t *testing.T) {
+	agent := &Agent{SpoolDirectory: t.TempDir()}
+
+	sink := &FileSink{Directory: "alerts"}
+	require.NoError(t, sink.Validate(agent))
+
+	for _, content := range []string{"first", "second"} {
+		message := &Message{
+			SubscriptionID: uuid.New(),
+			Content:        []byte(content),
+		}
+		require.NoError(t, sink.Deliver(context.TODO(), agent, message))
+	}
+
+	// Only complete messages are left, in the order they were written
+	entries, err := os.ReadDir(filepath.Join(agent.SpoolDirectory, "alerts"))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	for i, expected := range []string{"first", "second"} {
+		content, err := os.ReadFile(filepath.Join(agent.SpoolDirectory, "alerts", entries[i].Name()))
+		require.NoError(t, err)
+
+		var message Message
+		require.NoError(t, json.Unmarshal(content, &message))
+		assert.Equal(t, expected, string(message.Content))
+	}
+}
+
+func TestFileSinkValidate(t *testing.T) {
+	agent := &Agent{SpoolDirectory: t.TempDir()}
+
+	assert.NoError(t, (&FileSink{}).Validate(agent))
+	assert.NoError(t, (&FileSink{Directory: "a/b"}).Validate(agent))
+	assert.Error(t, (&FileSink{Directory: "../a"}).Validate(agent))
+	assert.Error(t, (&FileSink{Directory: "/tmp"}).Validate(agent))
+
+	// File sinks are disabled without a spool directory
+	assert.Error(t, (&FileSink{}).Validate(&Agent{}))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
+)
+
+var _ Sink = (*GotifySink)(nil)
+
+// DefaultGotifyPriorities maps urgencies to Gotify priorities. Gotify's
+// Android app shows messages of priority 1-3 silently, 4-7 with sound and
+// 8-10 as high priority notifications.
+var DefaultGotifyPriorities = map[webpush.Urgency]int{
+	webpush.UrgencyVeryLow: 1,
+	webpush.UrgencyLow:     3,
+	webpush.UrgencyNormal:  5,
+	webpush.UrgencyHigh:    8,
+}
+
+// GotifySink delivers messages to a Gotify server.
+// Declarative push messages are delivered using the notification's title and
+// body, opening the notification's navigation URL when clicked. Other messages
+// are delivered as-is. The urgency of a message determines its priority.
+// SEE: https://gotify.net/api-docs#/message/createMessage
+// SEE: https://gotify.net/docs/msgextras
+type GotifySink struct {
+	// URL is the base URL of the Gotify server, such as "https://example.com".
+	URL string `json:"url"`
+	// Token is the token of the Gotify application messages are created for.
+	Token string `json:"token"`
+	// Priorities optionally overrides the priority of urgencies. Urgencies not
+	// present use [DefaultGotifyPriorities].
+	Priorities map[webpush.Urgency]int `json:"priorities,omitempty"`
+}
+
+// gotifyMessage is the body of Gotify's create message request.
+type gotifyMessage struct {
+	Title    string         `json:"title,omitempty"`
+	Message  string         `json:"message"`
+	Priority int            `json:"priority"`
+	Extras   map[string]any `json:"extras,omitempty"`
+}
+
+// Validate implements Sink.
+func (s *GotifySink) Validate(agent *Agent) error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("gotify: url must be an absolute http or https URL")
+	}
+
+	if s.Token == "" {
+		return errors.New("gotify: token is required")
+	}
+
+	for urgency, priority := range s.Priorities {
+		if _, ok := DefaultGotifyPriorities[urgency]; !ok {
+			return fmt.Errorf("gotify: unknown urgency %q", urgency)
+		}
+
+		if priority < 0 || priority > 10 {
+			return fmt.Errorf("gotify: priority of %s must be between 0 and 10", urgency)
+		}
+	}
+
+	return nil
+}
+
+// Deliver implements Sink.
+// A Gotify message is created for message.
+func (s *GotifySink) Deliver(ctx context.Context, agent *Agent, message *Message) error {
+	body, err := json.Marshal(s.newMessage(message))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(s.URL, "/")+"/message", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", s.Token)
+
+	res, err := agent.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("gotify: unexpected status code: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// newMessage maps message to a Gotify message.
+func (s *GotifySink) newMessage(message *Message) *gotifyMessage {
+	urgency := message.Urgency
+	if urgency == "" {
+		urgency = webpush.UrgencyNormal
+	}
+
+	priority, ok := s.Priorities[urgency]
+	if !ok {
+		priority = DefaultGotifyPriorities[urgency]
+	}
+
+	notification := message.Notification()
+	if notification == nil {
+		// Opaque messages, and invalid declarative messages, are delivered as-is
+		return &gotifyMessage{
+			Message:  message.Text(),
+			Priority: priority,
+		}
+	}
+
+	// Gotify requires a message
+	content := notification.Body
+	if content == "" {
+		content = notification.Title
+	}
+
+	clientNotification := map[string]any{
+		"click": map[string]string{"url": notification.Navigate},
+	}
+	if notification.Image != "" {
+		clientNotification["bigImageUrl"] = notification.Image
+	}
+
+	return &gotifyMessage{
+		Title:    notification.Title,
+		Message:  content,
+		Priority: priority,
+		Extras: map[string]any{
+			"client::display":      map[string]string{"contentType": "text/plain"},
+			"client::notification": clientNotification,
+		},
+	}
+}
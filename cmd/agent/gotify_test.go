@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestGotify returns a Gotify stand-in, sending created messages to the
+// returned channel.
+func newTestGotify(t *testing.T, token string) (*httptest.Server, <-chan map[string]any) {
+	return newTestSinkServer(t, "POST /message", func(r *http.Request) bool {
+		return r.Header.Get("X-Gotify-Key") == token
+	})
+}
+
+func TestGotifySinkDeliver(t *testing.T) {
+	testCases := []struct {
+		Name       string
+		Priorities map[webpush.Urgency]int
+		Message    Message
+		Expected   map[string]any
+	}{
+		{
+			Name: "Opaque",
+			Message: Message{
+				Content: []byte("Hello, World!"),
+			},
+			Expected: map[string]any{
+				"message":  "Hello, World!",
+				"priority": float64(5),
+			},
+		},
+		{
+			Name: "Binary",
+			Message: Message{
+				Urgency: webpush.UrgencyLow,
+				Content: []byte{0xff, 0xfe},
+			},
+			Expected: map[string]any{
+				"message":  "//4=",
+				"priority": float64(3),
+			},
+		},
+		{
+			Name: "Declarative",
+			Message: Message{
+				Urgency:     webpush.UrgencyHigh,
+				ContentType: "application/notification+json",
+				Content:     []byte(`{"web_push":8030,"notification":{"title":"Hello","body":"World","navigate":"https://example.com"}}`),
+			},
+			Expected: map[string]any{
+				"title":    "Hello",
+				"message":  "World",
+				"priority": float64(8),
+				"extras": map[string]any{
+					"client::display": map[string]any{"contentType": "text/plain"},
+					"client::notification": map[string]any{
+						"click": map[string]any{"url": "https://example.com"},
+					},
+				},
+			},
+		},
+		{
+			Name: "Declarative without body",
+			Message: Message{
+				Content: []byte(`{"web_push":8030,"notification":{"title":"Hello","navigate":"https://example.com","image":"https://example.com/image.png"}}`),
+			},
+			Expected: map[string]any{
+				"title":    "Hello",
+				"message":  "Hello",
+				"priority": float64(5),
+				"extras": map[string]any{
+					"client::display": map[string]any{"contentType": "text/plain"},
+					"client::notification": map[string]any{
+						"click":       map[string]any{"url": "https://example.com"},
+						"bigImageUrl": "https://example.com/image.png",
+					},
+				},
+			},
+		},
+		{
+			Name: "Invalid declarative",
+			Message: Message{
+				Content: []byte(`{"web_push":8030}`),
+			},
+			Expected: map[string]any{
+				"message":  `{"web_push":8030}`,
+				"priority": float64(5),
+			},
+		},
+		{
+			Name:       "Priorities",
+			Priorities: map[webpush.Urgency]int{webpush.UrgencyVeryLow: 0},
+			Message: Message{
+				Urgency: webpush.UrgencyVeryLow,
+				Content: []byte("Hello, World!"),
+			},
+			Expected: map[string]any{
+				"message":  "Hello, World!",
+				"priority": float64(0),
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			server, messages := newTestGotify(t, "token")
+
+			sink := &GotifySink{
+				URL:        server.URL + "/",
+				Token:      "token",
+				Priorities: testCase.Priorities,
+			}
+			require.NoError(t, sink.Validate(&Agent{}))
+
+			require.NoError(t, sink.Deliver(context.TODO(), &Agent{Client: server.Client()}, &testCase.Message))
+			assert.Equal(t, testCase.Expected, <-messages)
+		})
+	}
+}
+
+func TestGotifySinkDeliverError(t *testing.T) {
+	server, _ := newTestGotify(t, "token")
+
+	sink := &GotifySink{
+		URL:   server.URL,
+		Token: "invalid",
+	}
+
+	err := sink.Deliver(context.TODO(), &Agent{Client: server.Client()}, &Message{Content: []byte("Hello, World!")})
+	assert.ErrorContains(t, err, "401")
+}
+
+func TestGotifySinkValidate(t *testing.T) {
+	testCases := []struct {
+		Name string
+		Sink GotifySink
+		Err  bool
+	}{
+		{Name: "Valid", Sink: GotifySink{URL: "https://example.com", Token: "token"}},
+		{Name: "Relative URL", Sink: GotifySink{URL: "/gotify", Token: "token"}, Err: true},
+		{Name: "Unsupported scheme", Sink: GotifySink{URL: "ftp://example.com", Token: "token"}, Err: true},
+		{Name: "No token", Sink: GotifySink{URL: "https://example.com"}, Err: true},
+		{Name: "Unknown urgency", Sink: GotifySink{URL: "https://example.com", Token: "token", Priorities: map[webpush.Urgency]int{"urgent": 10}}, Err: true},
+		{Name: "Priority out of range", Sink: GotifySink{URL: "https://example.com", Token: "token", Priorities: map[webpush.Urgency]int{webpush.UrgencyHigh: 11}}, Err: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			err := testCase.Sink.Validate(&Agent{})
+			if testCase.Err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Keyring holds the secrets tokens are sealed with, identified by key IDs.
+// New tokens are sealed with the primary secret, existing tokens are opened
+// using the secret identified by their key ID, letting secrets be rotated
+// without invalidating existing push endpoints.
+type Keyring struct {
+	// PrimaryKeyID identifies the secret new tokens are sealed with.
+	PrimaryKeyID uint8
+
+	secrets map[uint8][]byte
+}
+
+// NewKeyring creates a new [Keyring] holding a single, primary secret.
+func NewKeyring(keyID uint8, secret []byte) (*Keyring, error) {
+	keyring := &Keyring{
+		secrets: make(map[uint8][]byte),
+	}
+
+	if err := keyring.Add(keyID, secret); err != nil {
+		return nil, err
+	}
+	keyring.PrimaryKeyID = keyID
+
+	return keyring, nil
+}
+
+// ParseKeyring parses a keyring. Each line, or comma-separated entry, holds a
+// key ID and a base64url-encoded AES secret, separated by whitespace. Empty
+// lines and lines starting with # are ignored. The last secret is the primary
+// secret.
+//
+// Example, where each secret is 32 random bytes:
+//
+//	0 <base64url 32-byte secret>
+//	1 <base64url 32-byte secret>
+func ParseKeyring(text string) (*Keyring, error) {
+	keyring := &Keyring{
+		secrets: make(map[uint8][]byte),
+	}
+
+	entries := strings.FieldsFunc(text, func(r rune) bool {
+		return r == '\n' || r == ','
+	})
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid keyring entry")
+		}
+
+		keyID, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key ID: %w", err)
+		}
+
+		secret, err := base64.RawURLEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret for key ID %d: %w", keyID, err)
+		}
+
+		if err := keyring.Add(uint8(keyID), secret); err != nil {
+			return nil, err
+		}
+		keyring.PrimaryKeyID = uint8(keyID)
+	}
+
+	if len(keyring.secrets) == 0 {
+		return nil, errors.New("keyring is empty")
+	}
+
+	return keyring, nil
+}
+
+// LoadKeyring reads a keyring from a file. See [ParseKeyring].
+func LoadKeyring(path string) (*Keyring, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseKeyring(string(text))
+}
+
+// Add adds a secret. The secret must be a valid AES-128, AES-192 or AES-256
+// key.
+func (k *Keyring) Add(keyID uint8, secret []byte) error {
+	switch len(secret) {
+	case 16, 24, 32:
+	default:
+		return fmt.Errorf("invalid secret size for key ID %d", keyID)
+	}
+
+	if _, ok := k.secrets[keyID]; ok {
+		return fmt.Errorf("duplicate key ID %d", keyID)
+	}
+
+	k.secrets[keyID] = secret
+	return nil
+}
+
+// Seal seals a token using the primary secret, returning it encoded as a
+// string.
+func (k *Keyring) Seal(token *Token) (string, error) {
+	secret, ok := k.secrets[k.PrimaryKeyID]
+	if !ok {
+		return "", fmt.Errorf("missing primary secret")
+	}
+
+	token.KeyID = k.PrimaryKeyID
+	return token.SealString(secret)
+}
+
+// Open opens a token encoded as a string, using the secret identified by the
+// token's key ID. Version 1 tokens are opened using key ID 0.
+func (k *Keyring) Open(ciphertext string) (*Token, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyID uint8
+	if len(bytes) >= 2 && bytes[0] >= TokenVersion2 {
+		keyID = bytes[1]
+	}
+
+	secret, ok := k.secrets[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %d", keyID)
+	}
+
+	var token Token
+	if err := token.Open(bytes, secret); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// Reseal opens a token and seals it anew using the primary secret, upgrading
+// it to the latest version. Tokens already sealed using the latest version and
+// the primary secret are returned as is.
+// Version 1 tokens cannot be resealed, as they lack the authentication secret.
+func (k *Keyring) Reseal(ciphertext string) (string, error) {
+	token, err := k.Open(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	if token.Version < TokenVersion2 {
+		return "", errors.New("version 1 tokens cannot be resealed")
+	}
+
+	if token.Version == TokenVersion3 && token.KeyID == k.PrimaryKeyID {
+		return ciphertext, nil
+	}
+
+	token.Version = TokenVersion3
+	return k.Seal(token)
+}
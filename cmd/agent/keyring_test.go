@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKeyring(t *testing.T) {
+	testCases := []struct {
+		Name                 string
+		Text                 string
+		ExpectedPrimaryKeyID uint8
+		Error                bool
+	}{
+		{
+			Name:                 "Single",
+			Text:                 "0 OPMLk5kfCaEEVMz1cleOM8VdlCCThTlBv55f8ZsNnro",
+			ExpectedPrimaryKeyID: 0,
+		},
+		{
+			Name:                 "Lines",
+			Text:                 "# Rotated 2025-02-16\n0 OPMLk5kfCaEEVMz1cleOM8VdlCCThTlBv55f8ZsNnro\n\n1 CUVFJEQtOLhKc-A9xuIvRqvmC_IpS8WI5T6YuPAhD6A\n",
+			ExpectedPrimaryKeyID: 1,
+		},
+		{
+			Name:                 "Comma-separated",
+			Text:                 "2 OPMLk5kfCaEEVMz1cleOM8VdlCCThTlBv55f8ZsNnro, 1 CUVFJEQtOLhKc-A9xuIvRqvmC_IpS8WI5T6YuPAhD6A",
+			ExpectedPrimaryKeyID: 1,
+		},
+		{
+			Name:  "Empty",
+			Text:  "# Nothing here\n",
+			Error: true,
+		},
+		{
+			Name:  "Duplicate",
+			Text:  "0 OPMLk5kfCaEEVMz1cleOM8VdlCCThTlBv55f8ZsNnro\n0 CUVFJEQtOLhKc-A9xuIvRqvmC_IpS8WI5T6YuPAhD6A",
+			Error: true,
+		},
+		{
+			Name:  "Invalid key ID",
+			Text:  "256 OPMLk5kfCaEEVMz1cleOM8VdlCCThTlBv55f8ZsNnro",
+			Error: true,
+		},
+		{
+			Name:  "Invalid secret size",
+			Text:  "0 OPMLk5kfCaEE",
+			Error: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			keyring, err := ParseKeyring(testCase.Text)
+			if testCase.Error {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testCase.ExpectedPrimaryKeyID, keyring.PrimaryKeyID)
+		})
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	userAgentPrivateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	token := Token{
+		Version:                    TokenVersion2,
+		SubscriptionID:             uuid.New(),
+		ApplicationServerPublicKey: userAgentPrivateKey.PublicKey(),
+		UserAgentPrivateKey:        userAgentPrivateKey,
+		AuthenticationSecret:       make([]byte, 16),
+	}
+
+	oldKeyring, err := ParseKeyring("0 OPMLk5kfCaEEVMz1cleOM8VdlCCThTlBv55f8ZsNnro")
+	require.NoError(t, err)
+
+	sealed, err := oldKeyring.Seal(&token)
+	require.NoError(t, err)
+
+	// Tokens sealed with the old secret still open after rotation
+	keyring, err := ParseKeyring("0 OPMLk5kfCaEEVMz1cleOM8VdlCCThTlBv55f8ZsNnro\n1 CUVFJEQtOLhKc-A9xuIvRqvmC_IpS8WI5T6YuPAhD6A")
+	require.NoError(t, err)
+
+	opened, err := keyring.Open(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(0), opened.KeyID)
+	assert.Equal(t, token.SubscriptionID, opened.SubscriptionID)
+
+	// Resealed tokens use the new secret, opening once the old one is removed
+	resealed, err := keyring.Reseal(sealed)
+	require.NoError(t, err)
+
+	newKeyring, err := ParseKeyring("1 CUVFJEQtOLhKc-A9xuIvRqvmC_IpS8WI5T6YuPAhD6A")
+	require.NoError(t, err)
+
+	opened, err = newKeyring.Open(resealed)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(1), opened.KeyID)
+	assert.Equal(t, TokenVersion3, opened.Version)
+	assert.Equal(t, token.SubscriptionID, opened.SubscriptionID)
+
+	_, err = newKeyring.Open(sealed)
+	assert.ErrorContains(t, err, "unknown key ID 0")
+
+	// Tokens sealed using the primary secret are left as is
+	again, err := keyring.Reseal(resealed)
+	require.NoError(t, err)
+	assert.Equal(t, resealed, again)
+}
+
+func TestKeyringVersion1(t *testing.T) {
+	userAgentPrivateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	keyring, err := ParseKeyring("0 OPMLk5kfCaEEVMz1cleOM8VdlCCThTlBv55f8ZsNnro\n1 CUVFJEQtOLhKc-A9xuIvRqvmC_IpS8WI5T6YuPAhD6A")
+	require.NoError(t, err)
+
+	token := Token{
+		Version:                    TokenVersion1,
+		SubscriptionID:             uuid.New(),
+		ApplicationServerPublicKey: userAgentPrivateKey.PublicKey(),
+		UserAgentPrivateKey:        userAgentPrivateKey,
+	}
+
+	// Version 1 tokens were sealed with the only secret there was
+	sealed, err := token.SealString(keyring.secrets[0])
+	require.NoError(t, err)
+
+	_, err = keyring.Open(sealed)
+	require.NoError(t, err)
+
+	_, err = keyring.Reseal(sealed)
+	assert.Error(t, err)
+}
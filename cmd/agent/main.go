@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"crypto/ecdh"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
 )
@@ -14,21 +23,81 @@ import (
 func main() {
 	slog.SetLogLoggerLevel(slog.LevelDebug)
 
-	secret, err := base64.RawURLEncoding.DecodeString("OPMLk5kfCaEEVMz1cleOM8VdlCCThTlBv55f8ZsNnro")
+	keyringPath := flag.String("keyring", os.Getenv("AGENT_KEYRING_FILE"), "path to a keyring file holding the secrets tokens are sealed with (AGENT_KEYRING_FILE). The keyring may also be specified using AGENT_KEYRING")
+	revocationsPath := flag.String("revocations", os.Getenv("AGENT_REVOCATIONS_FILE"), "path to a file in which to persist revoked subscriptions (AGENT_REVOCATIONS_FILE). Revocations are kept in memory if unset")
+	commandDirectory := flag.String("command-directory", os.Getenv("AGENT_COMMAND_DIRECTORY"), "path to a directory holding the commands exec sinks may run (AGENT_COMMAND_DIRECTORY). Exec sinks are disabled if unset")
+	spoolDirectory := flag.String("spool-directory", os.Getenv("AGENT_SPOOL_DIRECTORY"), "path to a directory file sinks write messages to (AGENT_SPOOL_DIRECTORY). File sinks are disabled if unset")
+	sinksPath := flag.String("sinks", os.Getenv("AGENT_SINKS_FILE"), "path to a JSON file holding the sinks subscriptions may use, keyed by name (AGENT_SINKS_FILE). Messages are written to stdout if unset")
+	tokenLifetime := flag.Duration("token-lifetime", envDuration("AGENT_TOKEN_LIFETIME"), "time subscriptions are valid for, such as 720h (AGENT_TOKEN_LIFETIME). Subscriptions never expire if unset")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [flags] reseal [endpoint...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	keyring, err := loadKeyring(*keyringPath)
 	if err != nil {
-		panic(err)
+		slog.Error("Failed to load keyring", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "reseal":
+		os.Exit(reseal(keyring, flag.Args()[1:]))
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	revocations := NewRevocationList()
+	if *revocationsPath != "" {
+		revocations, err = OpenRevocationList(*revocationsPath)
+		if err != nil {
+			slog.Error("Failed to open revocation list", slog.Any("error", err))
+			os.Exit(1)
+		}
+		defer revocations.Close()
 	}
 
+	// Forget revocations of expired subscriptions
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			if err := revocations.Prune(time.Now()); err != nil {
+				slog.Error("Failed to prune revocations", slog.Any("error", err))
+			}
+			<-ticker.C
+		}
+	}()
+
 	agent := &Agent{
-		PushEndpoint: "http://localhost:8082/push",
-		Secret:       secret,
+		PushEndpoint:  "http://localhost:8082/push",
+		Keyring:       keyring,
+		TokenLifetime: *tokenLifetime,
+		Revocations:   revocations,
+
+		CommandDirectory: *commandDirectory,
+		SpoolDirectory:   *spoolDirectory,
 	}
 
-	// TODO: The push manager interface isn't that nice for what we're trying to
-	// do here. Essentially, the agent would like to access the manager's handle
-	// message function. Ugly circular dependency in this case
-	pushManager := webpush.NewPushManager(agent)
-	agent.Manager = pushManager
+	if *sinksPath != "" {
+		agent.Sinks, err = LoadSinks(*sinksPath)
+		if err != nil {
+			slog.Error("Failed to load sinks", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
+
+	for name, sink := range agent.Sinks {
+		if err := sink.Validate(agent); err != nil {
+			slog.Error("Invalid sink", slog.String("name", name), slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
 
 	pushServer := webpush.NewPushServer(agent)
 
@@ -41,7 +110,19 @@ func main() {
 			return
 		}
 
-		bytes, err := base64.RawURLEncoding.DecodeString(string(content))
+		// The body is either the application server's public key, or a JSON
+		// object holding the key and the subscription's sink
+		var request subscribeRequest
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+			if err := json.Unmarshal(content, &request); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+		} else {
+			request.ApplicationServerKey = string(content)
+		}
+
+		bytes, err := base64.RawURLEncoding.DecodeString(request.ApplicationServerKey)
 		if err != nil {
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
@@ -53,7 +134,12 @@ func main() {
 			return
 		}
 
-		subscription, err := pushManager.Subscribe(applicationServerPublickey)
+		if _, ok := agent.Sinks[request.Sink]; request.Sink != "" && !ok {
+			http.Error(w, "unknown sink", http.StatusBadRequest)
+			return
+		}
+
+		subscription, err := agent.NewSubscription(applicationServerPublickey, request.Sink)
 		if err != nil {
 			slog.Error("Failed to create subscription", slog.Any("error", err))
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -64,7 +150,42 @@ func main() {
 		w.WriteHeader(http.StatusCreated)
 		encoder := json.NewEncoder(w)
 		encoder.SetIndent("", "  ")
-		encoder.Encode(subscription)
+		encoder.Encode(&subscribeResponse{
+			Subscription: subscription,
+			Token:        subscription.Endpoint[strings.LastIndex(subscription.Endpoint, "/")+1:],
+		})
+	})
+
+	mux.HandleFunc("DELETE /subscribe/{token}", func(w http.ResponseWriter, r *http.Request) {
+		// The body is the subscription's authentication secret, proving
+		// ownership of the subscription
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		authenticationSecret, err := base64.RawURLEncoding.DecodeString(string(content))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		// As tokens are stateless, subscriptions are revoked rather than removed
+		err = agent.Revoke(r.PathValue("token"), authenticationSecret)
+		if errors.Is(err, webpush.ErrSubscriptionNotFound) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		} else if errors.Is(err, ErrNotOwner) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		} else if err != nil {
+			slog.Error("Failed to revoke subscription", slog.Any("error", err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
 	})
 
 	mux.Handle("/", pushServer)
@@ -74,3 +195,93 @@ func main() {
 		return
 	}
 }
+
+// subscribeRequest is the JSON body of a subscribe request.
+type subscribeRequest struct {
+	// ApplicationServerKey is the application server's public key, encoded
+	// using base64url.
+	ApplicationServerKey string `json:"applicationServerKey"`
+	// Sink is the optional name of the sink messages are delivered to, one of
+	// the sinks configured by the operator.
+	Sink string `json:"sink,omitempty"`
+}
+
+// subscribeResponse is the JSON body of a subscribe response.
+type subscribeResponse struct {
+	*webpush.Subscription
+	// Token is the token of the subscription's push endpoint, used to
+	// unsubscribe.
+	Token string `json:"token"`
+}
+
+// envDuration returns the duration held by the environment variable, or zero
+// if the variable is unset. Exits if the duration is invalid.
+func envDuration(name string) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Error("Failed to parse duration", slog.String("name", name), slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	return duration
+}
+
+// loadKeyring loads the keyring from a file, or from the AGENT_KEYRING
+// environment variable. If no keyring is configured, a random secret is used.
+func loadKeyring(path string) (*Keyring, error) {
+	if path != "" {
+		return LoadKeyring(path)
+	}
+
+	if text := os.Getenv("AGENT_KEYRING"); text != "" {
+		return ParseKeyring(text)
+	}
+
+	slog.Warn("No keyring configured, using a random secret. Push endpoints will not survive restarts")
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return NewKeyring(0, secret)
+}
+
+// reseal seals the tokens of push endpoints anew using the keyring's primary
+// secret, printing the new endpoints. Endpoints are read from stdin, one per
+// line, if none are given. Returns the exit code.
+func reseal(keyring *Keyring, endpoints []string) int {
+	if len(endpoints) == 0 {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if endpoint := strings.TrimSpace(scanner.Text()); endpoint != "" {
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			slog.Error("Failed to read endpoints", slog.Any("error", err))
+			return 1
+		}
+	}
+
+	exitCode := 0
+	for _, endpoint := range endpoints {
+		i := strings.LastIndex(endpoint, "/")
+
+		token, err := keyring.Reseal(endpoint[i+1:])
+		if err != nil {
+			slog.Error("Failed to reseal endpoint", slog.String("endpoint", endpoint), slog.Any("error", err))
+			exitCode = 1
+			continue
+		}
+
+		fmt.Println(endpoint[:i+1] + token)
+	}
+
+	return exitCode
+}
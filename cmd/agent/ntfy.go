@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
+)
+
+var _ Sink = (*NtfySink)(nil)
+
+// DefaultNtfyPriorities maps urgencies to ntfy priorities, leaving the
+// highest priority (5, urgent) unused.
+// SEE: https://docs.ntfy.sh/publish/#message-priority
+var DefaultNtfyPriorities = map[webpush.Urgency]int{
+	webpush.UrgencyVeryLow: 1,
+	webpush.UrgencyLow:     2,
+	webpush.UrgencyNormal:  3,
+	webpush.UrgencyHigh:    4,
+}
+
+// NtfySink delivers messages to an ntfy topic.
+// Declarative push messages are delivered using the notification's title and
+// body, opening the notification's navigation URL when clicked. Other messages
+// are delivered as-is. The urgency of a message determines its priority.
+// SEE: https://docs.ntfy.sh/publish/#publish-as-json
+type NtfySink struct {
+	// URL is the base URL of the ntfy server, such as "https://ntfy.sh".
+	URL   string `json:"url"`
+	Topic string `json:"topic"`
+	// Token is an optional access token.
+	Token string `json:"token,omitempty"`
+	// Priorities optionally overrides the priority of urgencies. Urgencies not
+	// present use [DefaultNtfyPriorities].
+	Priorities map[webpush.Urgency]int `json:"priorities,omitempty"`
+}
+
+// ntfyMessage is the body of ntfy's JSON publish request.
+type ntfyMessage struct {
+	Topic    string `json:"topic"`
+	Title    string `json:"title,omitempty"`
+	Message  string `json:"message"`
+	Priority int    `json:"priority"`
+	Click    string `json:"click,omitempty"`
+}
+
+// Validate implements Sink.
+func (s *NtfySink) Validate(agent *Agent) error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("ntfy: url must be an absolute http or https URL")
+	}
+
+	if s.Topic == "" {
+		return errors.New("ntfy: topic is required")
+	}
+
+	for urgency, priority := range s.Priorities {
+		if _, ok := DefaultNtfyPriorities[urgency]; !ok {
+			return fmt.Errorf("ntfy: unknown urgency %q", urgency)
+		}
+
+		if priority < 1 || priority > 5 {
+			return fmt.Errorf("ntfy: priority of %s must be between 1 and 5", urgency)
+		}
+	}
+
+	return nil
+}
+
+// Deliver implements Sink.
+// The message is published to the sink's topic.
+func (s *NtfySink) Deliver(ctx context.Context, agent *Agent, message *Message) error {
+	body, err := json.Marshal(s.newMessage(message))
+	if err != nil {
+		return err
+	}
+
+	// Publishing JSON is done to the server's root URL
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(s.URL, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+
+	res, err := agent.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("ntfy: unexpected status code: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// newMessage maps message to an ntfy message.
+func (s *NtfySink) newMessage(message *Message) *ntfyMessage {
+	urgency := message.Urgency
+	if urgency == "" {
+		urgency = webpush.UrgencyNormal
+	}
+
+	priority, ok := s.Priorities[urgency]
+	if !ok {
+		priority = DefaultNtfyPriorities[urgency]
+	}
+
+	notification := message.Notification()
+	if notification == nil {
+		// Opaque messages, and invalid declarative messages, are delivered as-is
+		return &ntfyMessage{
+			Topic:    s.Topic,
+			Message:  message.Text(),
+			Priority: priority,
+		}
+	}
+
+	// ntfy replaces empty messages with "triggered"
+	content := notification.Body
+	if content == "" {
+		content = notification.Title
+	}
+
+	return &ntfyMessage{
+		Topic:    s.Topic,
+		Title:    notification.Title,
+		Message:  content,
+		Priority: priority,
+		Click:    notification.Navigate,
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestNtfy returns an ntfy stand-in, sending published messages to the
+// returned channel.
+func newTestNtfy(t *testing.T, token string) (*httptest.Server, <-chan map[string]any) {
+	return newTestSinkServer(t, "POST /{$}", func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer "+token
+	})
+}
+
+func TestNtfySinkDeliver(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Message  Message
+		Expected map[string]any
+	}{
+		{
+			Name: "Opaque",
+			Message: Message{
+				Content: []byte("Hello, World!"),
+			},
+			Expected: map[string]any{
+				"topic":    "alerts",
+				"message":  "Hello, World!",
+				"priority": float64(3),
+			},
+		},
+		{
+			Name: "Declarative",
+			Message: Message{
+				Urgency: webpush.UrgencyVeryLow,
+				Content: []byte(`{"web_push":8030,"notification":{"title":"Hello","body":"World","navigate":"https://example.com"}}`),
+			},
+			Expected: map[string]any{
+				"topic":    "alerts",
+				"title":    "Hello",
+				"message":  "World",
+				"priority": float64(1),
+				"click":    "https://example.com",
+			},
+		},
+		{
+			Name: "Declarative without body",
+			Message: Message{
+				Content: []byte(`{"web_push":8030,"notification":{"title":"Hello","navigate":"https://example.com"}}`),
+			},
+			Expected: map[string]any{
+				"topic":    "alerts",
+				"title":    "Hello",
+				"message":  "Hello",
+				"priority": float64(3),
+				"click":    "https://example.com",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			server, messages := newTestNtfy(t, "token")
+
+			sink := &NtfySink{
+				URL:   server.URL,
+				Topic: "alerts",
+				Token: "token",
+			}
+			require.NoError(t, sink.Validate(&Agent{}))
+
+			require.NoError(t, sink.Deliver(context.TODO(), &Agent{Client: server.Client()}, &testCase.Message))
+			assert.Equal(t, testCase.Expected, <-messages)
+		})
+	}
+}
+
+func TestNtfySinkDeliverError(t *testing.T) {
+	server, _ := newTestNtfy(t, "token")
+
+	sink := &NtfySink{
+		URL:   server.URL,
+		Topic: "alerts",
+		Token: "invalid",
+	}
+
+	err := sink.Deliver(context.TODO(), &Agent{Client: server.Client()}, &Message{Content: []byte("Hello, World!")})
+	assert.ErrorContains(t, err, "401")
+}
+
+func TestNtfySinkValidate(t *testing.T) {
+	testCases := []struct {
+		Name string
+		Sink NtfySink
+		Err  bool
+	}{
+		{Name: "Valid", Sink: NtfySink{URL: "https://ntfy.sh", Topic: "alerts"}},
+		{Name: "Relative URL", Sink: NtfySink{URL: "/ntfy", Topic: "alerts"}, Err: true},
+		{Name: "No topic", Sink: NtfySink{URL: "https://ntfy.sh"}, Err: true},
+		{Name: "Priority out of range", Sink: NtfySink{URL: "https://ntfy.sh", Topic: "alerts", Priorities: map[webpush.Urgency]int{webpush.UrgencyLow: 0}}, Err: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			err := testCase.Sink.Validate(&Agent{})
+			if testCase.Err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
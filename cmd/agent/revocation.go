@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// revocationSize is the size of a persisted revocation, a raw 16-byte ID
+// followed by the time the subscription's token expires.
+const revocationSize = 16 + 8
+
+// RevocationList holds the IDs of revoked subscriptions. As tokens are
+// stateless, revocation is the only way to tear down a subscription.
+// Revocations are kept until the subscription's token expires, after which
+// the token is rejected anyway, see [RevocationList.Prune].
+// The list is optionally persisted to a file, holding revocations one after
+// another. Each revocation is the raw 16-byte ID followed by the expiry as
+// big-endian Unix seconds, zero if the token never expires.
+type RevocationList struct {
+	mutex sync.RWMutex
+	// revoked holds the time each revoked subscription's token expires.
+	revoked map[uuid.UUID]time.Time
+	file    *os.File
+}
+
+// NewRevocationList creates a new [RevocationList] kept in memory.
+func NewRevocationList() *RevocationList {
+	return &RevocationList{
+		revoked: make(map[uuid.UUID]time.Time),
+	}
+}
+
+// OpenRevocationList opens a [RevocationList] persisted to the file at path,
+// creating it if it doesn't exist.
+func OpenRevocationList(path string) (*RevocationList, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Ignore a trailing partial revocation, left by an interrupted write
+	if remainder := len(data) % revocationSize; remainder != 0 {
+		data = data[:len(data)-remainder]
+		if err := file.Truncate(int64(len(data))); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	if _, err := file.Seek(int64(len(data)), io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	revocations := NewRevocationList()
+	revocations.file = file
+	for i := 0; i < len(data); i += revocationSize {
+		var expiresAt time.Time
+		if seconds := int64(binary.BigEndian.Uint64(data[i+16 : i+revocationSize])); seconds != 0 {
+			expiresAt = fromUnixSeconds(seconds)
+		}
+		revocations.revoked[uuid.UUID(data[i:i+16])] = expiresAt
+	}
+
+	return revocations, nil
+}
+
+// Revoke revokes a subscription whose token expires at expiresAt. A zero
+// expiresAt keeps the revocation forever.
+func (r *RevocationList) Revoke(subscriptionID uuid.UUID, expiresAt time.Time) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.revoked[subscriptionID]; ok {
+		return nil
+	}
+
+	if r.file != nil {
+		if _, err := r.file.Write(encodeRevocation(subscriptionID, expiresAt)); err != nil {
+			return fmt.Errorf("failed to persist revocation: %w", err)
+		}
+
+		if err := r.file.Sync(); err != nil {
+			return fmt.Errorf("failed to persist revocation: %w", err)
+		}
+	}
+
+	r.revoked[subscriptionID] = expiresAt
+	return nil
+}
+
+// Revoked returns true if a subscription is revoked.
+func (r *RevocationList) Revoked(subscriptionID uuid.UUID) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	_, ok := r.revoked[subscriptionID]
+	return ok
+}
+
+// Prune removes the revocations of tokens that have expired at now, keeping
+// the list from growing forever. Expired tokens are rejected regardless of
+// whether they're revoked.
+func (r *RevocationList) Prune(now time.Time) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	pruned := 0
+	for subscriptionID, expiresAt := range r.revoked {
+		if !expiresAt.IsZero() && !now.Before(expiresAt) {
+			delete(r.revoked, subscriptionID)
+			pruned++
+		}
+	}
+
+	if r.file == nil || pruned == 0 {
+		return nil
+	}
+
+	// Rewrite the file with the remaining revocations
+	data := make([]byte, 0, len(r.revoked)*revocationSize)
+	for subscriptionID, expiresAt := range r.revoked {
+		data = append(data, encodeRevocation(subscriptionID, expiresAt)...)
+	}
+
+	if err := r.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to persist pruned revocations: %w", err)
+	}
+
+	if _, err := r.file.WriteAt(data, 0); err != nil {
+		return fmt.Errorf("failed to persist pruned revocations: %w", err)
+	}
+
+	if _, err := r.file.Seek(int64(len(data)), io.SeekStart); err != nil {
+		return fmt.Errorf("failed to persist pruned revocations: %w", err)
+	}
+
+	if err := r.file.Sync(); err != nil {
+		return fmt.Errorf("failed to persist pruned revocations: %w", err)
+	}
+
+	return nil
+}
+
+// Close closes the underlying file, if any.
+func (r *RevocationList) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	return r.file.Close()
+}
+
+// encodeRevocation encodes a revocation as persisted.
+func encodeRevocation(subscriptionID uuid.UUID, expiresAt time.Time) []byte {
+	data := make([]byte, revocationSize)
+	copy(data, subscriptionID[:])
+	if !expiresAt.IsZero() {
+		binary.BigEndian.PutUint64(data[16:], uint64(expiresAt.Unix()))
+	}
+	return data
+}
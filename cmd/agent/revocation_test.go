@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRevocationListPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations")
+
+	revoked := uuid.New()
+	other := uuid.New()
+
+	revocations, err := OpenRevocationList(path)
+	require.NoError(t, err)
+
+	require.NoError(t, revocations.Revoke(revoked, time.Time{}))
+	// Revoking twice is a no-op
+	require.NoError(t, revocations.Revoke(revoked, time.Time{}))
+	assert.True(t, revocations.Revoked(revoked))
+	assert.False(t, revocations.Revoked(other))
+	require.NoError(t, revocations.Close())
+
+	// Each revocation takes 24 bytes
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(24), info.Size())
+
+	// Simulate an interrupted write
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	revocations, err = OpenRevocationList(path)
+	require.NoError(t, err)
+	defer revocations.Close()
+
+	assert.True(t, revocations.Revoked(revoked))
+	assert.False(t, revocations.Revoked(other))
+
+	require.NoError(t, revocations.Revoke(other, time.Time{}))
+
+	revocations, err = OpenRevocationList(path)
+	require.NoError(t, err)
+	defer revocations.Close()
+
+	assert.True(t, revocations.Revoked(revoked))
+	assert.True(t, revocations.Revoked(other))
+}
+
+func TestRevocationListPrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations")
+
+	now := time.Now()
+	expired := uuid.New()
+	valid := uuid.New()
+	forever := uuid.New()
+
+	revocations, err := OpenRevocationList(path)
+	require.NoError(t, err)
+
+	require.NoError(t, revocations.Revoke(expired, fromUnixSeconds(now.Add(-time.Hour).Unix())))
+	require.NoError(t, revocations.Revoke(valid, fromUnixSeconds(now.Add(time.Hour).Unix())))
+	require.NoError(t, revocations.Revoke(forever, time.Time{}))
+
+	// Revocations are kept until the subscription expires
+	require.NoError(t, revocations.Prune(now))
+	assert.False(t, revocations.Revoked(expired))
+	assert.True(t, revocations.Revoked(valid))
+	assert.True(t, revocations.Revoked(forever))
+
+	// Revocations made after pruning are appended to the rewritten file
+	other := uuid.New()
+	require.NoError(t, revocations.Revoke(other, time.Time{}))
+	require.NoError(t, revocations.Close())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3*24), info.Size())
+
+	revocations, err = OpenRevocationList(path)
+	require.NoError(t, err)
+	defer revocations.Close()
+
+	assert.False(t, revocations.Revoked(expired))
+	assert.True(t, revocations.Revoked(valid))
+	assert.True(t, revocations.Revoked(forever))
+	assert.True(t, revocations.Revoked(other))
+
+	// Expiry is persisted
+	require.NoError(t, revocations.Prune(now.Add(2*time.Hour)))
+	assert.False(t, revocations.Revoked(valid))
+	assert.True(t, revocations.Revoked(forever))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"unicode/utf8"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
+	"github.com/google/uuid"
+)
+
+// Message is a decrypted push message, delivered to a sink.
+// The JSON encoding of a message is used by the webhook and file sinks. The
+// content is encoded using base64.
+type Message struct {
+	SubscriptionID uuid.UUID `json:"subscriptionId"`
+	Topic          string    `json:"topic,omitempty"`
+	// Urgency is the urgency of the message. Empty if not specified, which is
+	// equivalent to normal.
+	Urgency     webpush.Urgency `json:"urgency,omitempty"`
+	ContentType string          `json:"contentType,omitempty"`
+	Content     []byte          `json:"content"`
+}
+
+// Notification returns the notification of a declarative push message, or nil
+// if the message is opaque or an invalid declarative push message. The
+// message's navigation URL is used if the notification has none.
+func (m *Message) Notification() *webpush.DeclerativePushNotification {
+	declarativeMessage, err := webpush.ParseDeclarativePushMessage(m.Content)
+	if err != nil {
+		return nil
+	}
+
+	notification := declarativeMessage.Notification
+	if notification.Navigate == "" {
+		notification.Navigate = declarativeMessage.Navigate
+	}
+
+	return &notification
+}
+
+// Text returns the content as text. Content that is not valid UTF-8 is
+// encoded using base64.
+func (m *Message) Text() string {
+	if !utf8.Valid(m.Content) {
+		return base64.StdEncoding.EncodeToString(m.Content)
+	}
+
+	return string(m.Content)
+}
+
+// Sink delivers decrypted push messages.
+type Sink interface {
+	// Validate validates the sink's configuration. It's called when the sinks
+	// configured by the operator are loaded.
+	Validate(agent *Agent) error
+	// Deliver delivers message. Returning an error fails the push, letting the
+	// application server retry it.
+	Deliver(ctx context.Context, agent *Agent, message *Message) error
+}
+
+// SinkConfig configures where the messages of a subscription are delivered.
+// Sinks are configured by the operator, see [ParseSinks]. Exactly one sink
+// must be set.
+type SinkConfig struct {
+	Gotify  *GotifySink  `json:"gotify,omitempty"`
+	Webhook *WebhookSink `json:"webhook,omitempty"`
+	Ntfy    *NtfySink    `json:"ntfy,omitempty"`
+	Exec    *ExecSink    `json:"exec,omitempty"`
+	File    *FileSink    `json:"file,omitempty"`
+}
+
+// Sink returns the configured sink.
+func (c *SinkConfig) Sink() (Sink, error) {
+	var sinks []Sink
+	if c.Gotify != nil {
+		sinks = append(sinks, c.Gotify)
+	}
+	if c.Webhook != nil {
+		sinks = append(sinks, c.Webhook)
+	}
+	if c.Ntfy != nil {
+		sinks = append(sinks, c.Ntfy)
+	}
+	if c.Exec != nil {
+		sinks = append(sinks, c.Exec)
+	}
+	if c.File != nil {
+		sinks = append(sinks, c.File)
+	}
+
+	switch len(sinks) {
+	case 0:
+		return nil, errors.New("no sink configured")
+	case 1:
+		return sinks[0], nil
+	default:
+		return nil, errors.New("more than one sink configured")
+	}
+}
+
+// Validate validates the configuration.
+func (c *SinkConfig) Validate(agent *Agent) error {
+	sink, err := c.Sink()
+	if err != nil {
+		return err
+	}
+
+	return sink.Validate(agent)
+}
+
+// ParseSinks parses named sinks from a JSON object mapping names to sink
+// configurations. Subscribers choose a sink by its name, as sinks may reach
+// internal services or run commands.
+//
+// Example:
+//
+//	{"alerts": {"gotify": {"url": "https://gotify.example.com", "token": "<application token>"}}}
+func ParseSinks(content []byte) (map[string]*SinkConfig, error) {
+	var sinks map[string]*SinkConfig
+	if err := json.Unmarshal(content, &sinks); err != nil {
+		return nil, err
+	}
+
+	for name, config := range sinks {
+		if config == nil {
+			return nil, fmt.Errorf("sink %s: no sink configured", name)
+		}
+
+		if _, err := config.Sink(); err != nil {
+			return nil, fmt.Errorf("sink %s: %w", name, err)
+		}
+	}
+
+	return sinks, nil
+}
+
+// LoadSinks reads named sinks from a file. See [ParseSinks].
+func LoadSinks(path string) (map[string]*SinkConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSinks(content)
+}
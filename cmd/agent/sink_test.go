@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSinkServer returns a stand-in for a service receiving JSON messages
+// at pattern, such as "POST /message", sending received messages to the
+// returned channel. Requests not allowed by authorize are rejected.
+func newTestSinkServer(t *testing.T, pattern string, authorize func(r *http.Request) bool) (*httptest.Server, <-chan map[string]any) {
+	messages := make(chan map[string]any, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(r) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		var message map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		messages <- message
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(message)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server, messages
+}
+
+func TestSinkConfigSink(t *testing.T) {
+	gotify := &GotifySink{URL: "https://example.com", Token: "token"}
+
+	sink, err := (&SinkConfig{Gotify: gotify}).Sink()
+	require.NoError(t, err)
+	assert.Same(t, gotify, sink)
+
+	_, err = (&SinkConfig{}).Sink()
+	assert.Error(t, err)
+
+	_, err = (&SinkConfig{Gotify: gotify, Webhook: &WebhookSink{URL: "https://example.com"}}).Sink()
+	assert.Error(t, err)
+}
+
+func TestMessageNotification(t *testing.T) {
+	message := &Message{Content: []byte(`{"web_push":8030,"navigate":"https://example.com/a","notification":{"title":"Hello","navigate":"https://example.com/b"}}`)}
+	require.NotNil(t, message.Notification())
+	assert.Equal(t, "https://example.com/b", message.Notification().Navigate)
+
+	message = &Message{Content: []byte("Hello, World!")}
+	assert.Nil(t, message.Notification())
+	assert.Equal(t, "Hello, World!", message.Text())
+
+	message = &Message{Content: []byte{0xff}}
+	assert.Equal(t, "/w==", message.Text())
+}
+
+func TestParseSinks(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Content  string
+		Expected map[string]*SinkConfig
+		Error    bool
+	}{
+		{
+			Name:    "Valid",
+			Content: `{"alerts": {"gotify": {"url": "https://example.com", "token": "token"}}, "spool": {"file": {}}}`,
+			Expected: map[string]*SinkConfig{
+				"alerts": {Gotify: &GotifySink{URL: "https://example.com", Token: "token"}},
+				"spool":  {File: &FileSink{}},
+			},
+		},
+		{
+			Name:     "Empty",
+			Content:  `{}`,
+			Expected: map[string]*SinkConfig{},
+		},
+		{
+			Name:    "No sink",
+			Content: `{"alerts": {}}`,
+			Error:   true,
+		},
+		{
+			Name:    "Null sink",
+			Content: `{"alerts": null}`,
+			Error:   true,
+		},
+		{
+			Name:    "More than one sink",
+			Content: `{"alerts": {"file": {}, "exec": {"command": "notify"}}}`,
+			Error:   true,
+		},
+		{
+			Name:    "Invalid JSON",
+			Content: `[]`,
+			Error:   true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			sinks, err := ParseSinks([]byte(testCase.Content))
+			if testCase.Error {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, testCase.Expected, sinks)
+		})
+	}
+}
@@ -4,64 +4,154 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdh"
+	"crypto/elliptic"
+	"crypto/hkdf"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
+	"math"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// Token versions.
+const (
+	// TokenVersion1 holds the subscription ID, the application server's public
+	// key and the user agent's private key.
+	TokenVersion1 uint8 = 1
+	// TokenVersion2 adds the authentication secret, creation and expiry times
+	// and the ID of the key the token is sealed with.
+	TokenVersion2 uint8 = 2
+	// TokenVersion3 holds the same fields as version 2 in a compact encoding.
+	// The subscription ID is kept in the clear and used to derive a key of the
+	// token's own, removing the need for a nonce. The application server's
+	// public key is compressed and times are encoded
+	// using 32 bits. The optional, variable-length name of the subscription's
+	// sink follows the fixed-size fields.
+	TokenVersion3 uint8 = 3
+)
+
 // Token holds everything required to handle push messages in a stateless way.
 // Note that we don't target the same scale as major vendors, so we don't need
 // to consider things like partitioning keys. We assume that a single backend
 // instance is used.
-// Once sealed, all contents of the token, but the version is encrypted.
+// Once sealed, all contents of the token, but the version and key ID (and
+// subscription ID as of version 3) is encrypted.
 // TODO: The intention is that exposing subscription ids or public keys would
 // greater risk fingerprinting? Why the private key is encrypted is obvious.
-// TODO: We need the authentication secret as well for this to properly survive
-// restarts
 type Token struct {
-	Version                    uint8
-	SubscriptionID             uuid.UUID
+	Version uint8
+	// KeyID identifies the secret the token is sealed with.
+	// Version 2 and later.
+	KeyID          uint8
+	SubscriptionID uuid.UUID
+	// CreatedAt is the time the token was created, in seconds.
+	// Version 2 and later.
+	CreatedAt time.Time
+	// ExpiresAt is the time the token expires, in seconds. Zero if the token
+	// never expires.
+	// Version 2 and later.
+	ExpiresAt                  time.Time
 	ApplicationServerPublicKey *ecdh.PublicKey
 	UserAgentPrivateKey        *ecdh.PrivateKey
+	// AuthenticationSecret is the subscription's authentication secret.
+	// Version 2 and later.
+	AuthenticationSecret []byte
+	// Sink is the name of the sink the subscription's messages are delivered
+	// to, see [Agent.Sinks]. Empty for the default sink.
+	// Version 3 and later.
+	Sink string
+}
+
+// Expired returns true if the token has expired at now.
+func (t *Token) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
 }
 
 func (t *Token) Seal(secret []byte) ([]byte, error) {
-	block, err := aes.NewCipher(secret)
+	aead, err := newAEAD(secret)
 	if err != nil {
 		return nil, err
 	}
 
-	aead, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
+	var header, data []byte
+	switch t.Version {
+	case TokenVersion1:
+		header = []byte{t.Version}
+
+		// Size assumes P-256
+		data = make([]byte, 16+65+32)
+		copy(data[0:16], t.SubscriptionID[:])
+		copy(data[16:81], t.ApplicationServerPublicKey.Bytes())
+		copy(data[81:113], t.UserAgentPrivateKey.Bytes())
+	case TokenVersion2:
+		if len(t.AuthenticationSecret) != 16 {
+			return nil, fmt.Errorf("invalid authentication secret size")
+		}
+
+		header = []byte{t.Version, t.KeyID}
+
+		// Size assumes P-256
+		data = make([]byte, 16+8+8+65+32+16)
+		copy(data[0:16], t.SubscriptionID[:])
+		binary.BigEndian.PutUint64(data[16:24], uint64(unixSeconds(t.CreatedAt)))
+		binary.BigEndian.PutUint64(data[24:32], uint64(unixSeconds(t.ExpiresAt)))
+		copy(data[32:97], t.ApplicationServerPublicKey.Bytes())
+		copy(data[97:129], t.UserAgentPrivateKey.Bytes())
+		copy(data[129:145], t.AuthenticationSecret)
+	case TokenVersion3:
+		if len(t.AuthenticationSecret) != 16 {
+			return nil, fmt.Errorf("invalid authentication secret size")
+		}
+
+		createdAt, err := unixSeconds32(t.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		expiresAt, err := unixSeconds32(t.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+
+		header = make([]byte, 2+16)
+		header[0] = t.Version
+		header[1] = t.KeyID
+		copy(header[2:18], t.SubscriptionID[:])
+
+		// Size assumes P-256
+		data = make([]byte, 4+4+33+32+16, 4+4+33+32+16+len(t.Sink))
+		binary.BigEndian.PutUint32(data[0:4], createdAt)
+		binary.BigEndian.PutUint32(data[4:8], expiresAt)
+		copy(data[8:41], compressPublicKey(t.ApplicationServerPublicKey))
+		copy(data[41:73], t.UserAgentPrivateKey.Bytes())
+		copy(data[73:89], t.AuthenticationSecret)
+		data = append(data, t.Sink...)
+
+		aead, err := newTokenAEAD(secret, t.SubscriptionID)
+		if err != nil {
+			return nil, err
+		}
+
+		// Encrypt all fields but the header. The key is unique to the token, so
+		// there is no nonce to append
+		return aead.Seal(header, make([]byte, aead.NonceSize()), data, additionalData(header)), nil
+	default:
+		return nil, fmt.Errorf("unsupported token version")
 	}
 
-	// TODO: We could probably derive the nonce to save a few bytes, for example
-	// by using the private key, as it's known to be ephemeral and unique to this
-	// subscription. It would be somewhat similar to the "sealed_box" crypto_box
-	// adaptation with ephemeral sender keys.
-	// nonce = blake2b(ephemeral_pk || subscription id)
 	nonce := make([]byte, aead.NonceSize())
 	if _, err := rand.Read(nonce); err != nil {
 		return nil, err
 	}
 
-	// Size assumes P-256
-	data := make([]byte, 16+65+32)
-	copy(data[0:16], t.SubscriptionID[:])
-	copy(data[16:81], t.ApplicationServerPublicKey.Bytes())
-	copy(data[81:113], t.UserAgentPrivateKey.Bytes())
-
-	// Include the version in the AD as we don't intend to encrypt it, but like to
-	// verify it
-	info := fmt.Sprintf("Web Push PoC Version %d\x00", t.Version)
+	// Encrypt all fields but the header
+	data = aead.Seal(data[:0], nonce, data, additionalData(header))
 
-	// Encrypt all fields but the version
-	data = aead.Seal(data[:0], nonce, data, []byte(info))
-
-	ciphertext := []byte{t.Version}
+	ciphertext := header
 	ciphertext = append(ciphertext, data...)
 	ciphertext = append(ciphertext, nonce...)
 
@@ -78,46 +168,120 @@ func (t *Token) SealString(secret []byte) (string, error) {
 }
 
 func (t *Token) Open(ciphertext []byte, secret []byte) error {
+	if len(ciphertext) == 0 {
+		return fmt.Errorf("invalid token size")
+	}
+
 	version := ciphertext[0]
-	if version != 0x01 {
+
+	var headerSize int
+	switch version {
+	case TokenVersion1:
+		headerSize = 1
+	case TokenVersion2:
+		headerSize = 2
+	case TokenVersion3:
+		headerSize = 2 + 16
+	default:
 		return fmt.Errorf("unsupported token version")
 	}
 
-	block, err := aes.NewCipher(secret)
-	if err != nil {
-		return err
+	if len(ciphertext) < headerSize {
+		return fmt.Errorf("invalid token size")
 	}
 
-	aead, err := cipher.NewGCM(block)
+	var aead cipher.AEAD
+	var err error
+	if version == TokenVersion3 {
+		aead, err = newTokenAEAD(secret, uuid.UUID(ciphertext[2:18]))
+	} else {
+		aead, err = newAEAD(secret)
+	}
 	if err != nil {
 		return err
 	}
 
-	info := fmt.Sprintf("Web Push PoC Version %d\x00", version)
+	nonceSize := aead.NonceSize()
+	if version == TokenVersion3 {
+		// The key is unique to the token, the nonce is always zero
+		nonceSize = 0
+	}
 
-	nonce := ciphertext[len(ciphertext)-aead.NonceSize():]
-	data := ciphertext[1 : len(ciphertext)-aead.NonceSize()]
+	if len(ciphertext) < headerSize+aead.Overhead()+nonceSize {
+		return fmt.Errorf("invalid token size")
+	}
+
+	header := ciphertext[:headerSize]
+	data := ciphertext[headerSize : len(ciphertext)-nonceSize]
+
+	var nonce []byte
+	if version == TokenVersion3 {
+		nonce = make([]byte, aead.NonceSize())
+	} else {
+		nonce = ciphertext[len(ciphertext)-nonceSize:]
+	}
 
-	plaintext, err := aead.Open(data[:0], nonce, data, []byte(info))
+	// Don't decrypt in place, the ciphertext is not ours
+	plaintext, err := aead.Open(nil, nonce, data, additionalData(header))
 	if err != nil {
 		return err
 	}
 
-	token := Token{}
-	token.Version = version
-	copy(token.SubscriptionID[:], plaintext[0:16])
+	token := Token{
+		Version: version,
+	}
+
+	var applicationServerPublicKey, userAgentPrivateKey []byte
+	switch version {
+	case TokenVersion1:
+		if len(plaintext) != 16+65+32 {
+			return fmt.Errorf("invalid token size")
+		}
+
+		copy(token.SubscriptionID[:], plaintext[0:16])
+		applicationServerPublicKey = plaintext[16:81]
+		userAgentPrivateKey = plaintext[81:113]
+	case TokenVersion2:
+		if len(plaintext) != 16+8+8+65+32+16 {
+			return fmt.Errorf("invalid token size")
+		}
+
+		token.KeyID = header[1]
+		copy(token.SubscriptionID[:], plaintext[0:16])
+		token.CreatedAt = fromUnixSeconds(int64(binary.BigEndian.Uint64(plaintext[16:24])))
+		token.ExpiresAt = fromUnixSeconds(int64(binary.BigEndian.Uint64(plaintext[24:32])))
+		applicationServerPublicKey = plaintext[32:97]
+		userAgentPrivateKey = plaintext[97:129]
+		token.AuthenticationSecret = plaintext[129:145]
+	case TokenVersion3:
+		if len(plaintext) < 4+4+33+32+16 {
+			return fmt.Errorf("invalid token size")
+		}
 
-	applicationServerPublicKey, err := ecdh.P256().NewPublicKey(plaintext[16:81])
+		token.KeyID = header[1]
+		copy(token.SubscriptionID[:], header[2:18])
+		token.CreatedAt = fromUnixSeconds(int64(binary.BigEndian.Uint32(plaintext[0:4])))
+		token.ExpiresAt = fromUnixSeconds(int64(binary.BigEndian.Uint32(plaintext[4:8])))
+		applicationServerPublicKey, err = decompressPublicKey(plaintext[8:41])
+		if err != nil {
+			return err
+		}
+		userAgentPrivateKey = plaintext[41:73]
+		token.AuthenticationSecret = plaintext[73:89]
+		if len(plaintext) > 89 {
+			token.Sink = string(plaintext[89:])
+		}
+	}
+
+	token.ApplicationServerPublicKey, err = ecdh.P256().NewPublicKey(applicationServerPublicKey)
 	if err != nil {
 		return err
 	}
-	token.ApplicationServerPublicKey = applicationServerPublicKey
 
-	userAgentPrivateKey, err := ecdh.P256().NewPrivateKey(plaintext[81:113])
+	token.UserAgentPrivateKey, err = ecdh.P256().NewPrivateKey(userAgentPrivateKey)
 	if err != nil {
 		return err
 	}
-	token.UserAgentPrivateKey = userAgentPrivateKey
 
 	*t = token
 	return nil
@@ -131,3 +295,94 @@ func (t *Token) OpenString(ciphertext string, secret []byte) error {
 
 	return t.Open(bytes, secret)
 }
+
+func newAEAD(secret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// additionalData returns the additional data for a token's header.
+// The header is included in the AD as we don't intend to encrypt it, but like
+// to verify it.
+func additionalData(header []byte) []byte {
+	ad := []byte(fmt.Sprintf("Web Push PoC Version %d\x00", header[0]))
+	// Version 1 only includes the version, keep it compatible
+	return append(ad, header[1:]...)
+}
+
+// unixSeconds returns t as seconds since the Unix epoch, or 0 if t is zero.
+func unixSeconds(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// fromUnixSeconds is the inverse of unixSeconds.
+func fromUnixSeconds(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0).UTC()
+}
+
+// unixSeconds32 returns t as seconds since the Unix epoch, or 0 if t is zero.
+// Returns an error if t cannot be represented using 32 bits.
+func unixSeconds32(t time.Time) (uint32, error) {
+	seconds := unixSeconds(t)
+	if seconds < 0 || seconds > math.MaxUint32 {
+		return 0, fmt.Errorf("time out of range")
+	}
+	return uint32(seconds), nil
+}
+
+// newTokenAEAD returns the AEAD of a version 3 token, keyed by a key derived
+// from secret and the token's subscription ID. As each key seals a single
+// token, a fixed nonce is used. Sealing a token again, such as when resealing
+// it, produces the very same ciphertext. Should a token ever be sealed with
+// different contents for an existing subscription ID, only that token is
+// affected, rather than the secret shared by all tokens as with a derived
+// nonce. [Keyring.Reseal] leaves tokens that are already sealed using the
+// latest version and primary secret untouched.
+// NOTE: The ephemeral user agent key, while unique, is encrypted and therefore
+// unknown until the token is opened. The subscription ID is kept in the clear
+// instead.
+func newTokenAEAD(secret []byte, subscriptionID uuid.UUID) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, subscriptionID[:], "Web Push PoC Token\x00", len(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	return newAEAD(key)
+}
+
+// compressPublicKey returns the compressed form of a P-256 public key.
+// SEE: https://www.secg.org/sec1-v2.pdf section 2.3.3
+func compressPublicKey(publicKey *ecdh.PublicKey) []byte {
+	// The uncompressed form is 0x04 || x || y
+	bytes := publicKey.Bytes()
+
+	compressed := make([]byte, 33)
+	// The prefix indicates whether y is even or odd
+	compressed[0] = 0x02 | bytes[64]&1
+	copy(compressed[1:], bytes[1:33])
+	return compressed
+}
+
+// decompressPublicKey parses a compressed P-256 public key.
+func decompressPublicKey(compressed []byte) ([]byte, error) {
+	x, y := elliptic.UnmarshalCompressed(elliptic.P256(), compressed)
+	if x == nil {
+		return nil, fmt.Errorf("invalid compressed public key")
+	}
+
+	bytes := make([]byte, 65)
+	bytes[0] = 0x04
+	x.FillBytes(bytes[1:33])
+	y.FillBytes(bytes[33:65])
+	return bytes, nil
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"crypto/ecdh"
+	"crypto/rand"
 	"encoding/base64"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -31,7 +33,7 @@ func TestTokenRoundtrip(t *testing.T) {
 	require.NoError(t, err)
 
 	token := Token{
-		Version:                    1,
+		Version:                    TokenVersion1,
 		SubscriptionID:             subscriptionID,
 		ApplicationServerPublicKey: applicationServerPublicKey,
 		UserAgentPrivateKey:        userAgentPrivateKey,
@@ -47,3 +49,205 @@ func TestTokenRoundtrip(t *testing.T) {
 
 	assert.Equal(t, token, actualToken)
 }
+
+func TestTokenV2Roundtrip(t *testing.T) {
+	applicationServerPrivateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	userAgentPrivateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	secret, err := base64.RawURLEncoding.DecodeString("OPMLk5kfCaEEVMz1cleOM8VdlCCThTlBv55f8ZsNnro")
+	require.NoError(t, err)
+
+	createdAt := time.Date(2025, 2, 16, 12, 0, 0, 0, time.UTC)
+
+	token := Token{
+		Version:                    TokenVersion2,
+		KeyID:                      3,
+		SubscriptionID:             uuid.New(),
+		CreatedAt:                  createdAt,
+		ExpiresAt:                  createdAt.Add(24 * time.Hour),
+		ApplicationServerPublicKey: applicationServerPrivateKey.PublicKey(),
+		UserAgentPrivateKey:        userAgentPrivateKey,
+		AuthenticationSecret:       []byte("0123456789abcdef"),
+	}
+
+	ciphertext, err := token.Seal(secret)
+	require.NoError(t, err)
+
+	var actualToken Token
+	require.NoError(t, actualToken.Open(ciphertext, secret))
+	assert.Equal(t, token, actualToken)
+
+	assert.False(t, actualToken.Expired(createdAt))
+	assert.True(t, actualToken.Expired(createdAt.Add(24*time.Hour)))
+
+	// The key ID is authenticated
+	ciphertext[1] = 4
+	assert.Error(t, actualToken.Open(ciphertext, secret))
+}
+
+func TestTokenV2NoExpiry(t *testing.T) {
+	userAgentPrivateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	secret := make([]byte, 32)
+
+	token := Token{
+		Version:                    TokenVersion2,
+		SubscriptionID:             uuid.New(),
+		CreatedAt:                  time.Unix(1739707200, 0).UTC(),
+		ApplicationServerPublicKey: userAgentPrivateKey.PublicKey(),
+		UserAgentPrivateKey:        userAgentPrivateKey,
+		AuthenticationSecret:       make([]byte, 16),
+	}
+
+	ciphertext, err := token.SealString(secret)
+	require.NoError(t, err)
+
+	var actualToken Token
+	require.NoError(t, actualToken.OpenString(ciphertext, secret))
+	assert.True(t, actualToken.ExpiresAt.IsZero())
+	assert.False(t, actualToken.Expired(time.Now().AddDate(100, 0, 0)))
+}
+
+func TestTokenV3Roundtrip(t *testing.T) {
+	applicationServerPrivateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	userAgentPrivateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	secret, err := base64.RawURLEncoding.DecodeString("OPMLk5kfCaEEVMz1cleOM8VdlCCThTlBv55f8ZsNnro")
+	require.NoError(t, err)
+
+	createdAt := time.Date(2025, 2, 16, 12, 0, 0, 0, time.UTC)
+
+	token := Token{
+		Version:                    TokenVersion3,
+		KeyID:                      1,
+		SubscriptionID:             uuid.New(),
+		CreatedAt:                  createdAt,
+		ExpiresAt:                  createdAt.Add(24 * time.Hour),
+		ApplicationServerPublicKey: applicationServerPrivateKey.PublicKey(),
+		UserAgentPrivateKey:        userAgentPrivateKey,
+		AuthenticationSecret:       []byte("0123456789abcdef"),
+	}
+
+	ciphertext, err := token.Seal(secret)
+	require.NoError(t, err)
+	// Header, encrypted fields and authentication tag
+	assert.Len(t, ciphertext, 18+89+16)
+
+	// The key is derived, sealing the same token yields the same ciphertext
+	again, err := token.Seal(secret)
+	require.NoError(t, err)
+	assert.Equal(t, ciphertext, again)
+
+	// Each subscription is sealed using a key of its own, so the same contents
+	// are encrypted differently
+	other := token
+	other.SubscriptionID = uuid.New()
+	otherCiphertext, err := other.Seal(secret)
+	require.NoError(t, err)
+	assert.NotEqual(t, ciphertext[18:18+89], otherCiphertext[18:18+89])
+
+	var actualToken Token
+	require.NoError(t, actualToken.Open(ciphertext, secret))
+	assert.Equal(t, token, actualToken)
+
+	// The subscription ID is authenticated
+	ciphertext[2] ^= 1
+	assert.Error(t, actualToken.Open(ciphertext, secret))
+
+	// The sink is appended to the fixed-size fields
+	token.Sink = "alerts"
+	ciphertext, err = token.Seal(secret)
+	require.NoError(t, err)
+	assert.Len(t, ciphertext, 18+89+len(token.Sink)+16)
+	require.NoError(t, actualToken.Open(ciphertext, secret))
+	assert.Equal(t, token, actualToken)
+
+	// Times must fit in 32 bits
+	token.ExpiresAt = time.Date(2107, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err = token.Seal(secret)
+	assert.Error(t, err)
+}
+
+func TestCompressPublicKey(t *testing.T) {
+	for range 32 {
+		privateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		compressed := compressPublicKey(privateKey.PublicKey())
+		require.Len(t, compressed, 33)
+
+		decompressed, err := decompressPublicKey(compressed)
+		require.NoError(t, err)
+		assert.Equal(t, privateKey.PublicKey().Bytes(), decompressed)
+	}
+
+	_, err := decompressPublicKey(make([]byte, 33))
+	assert.Error(t, err)
+}
+
+func TestTokenOpenInvalid(t *testing.T) {
+	secret := make([]byte, 32)
+
+	testCases := []struct {
+		Name       string
+		Ciphertext []byte
+	}{
+		{Name: "Empty", Ciphertext: []byte{}},
+		{Name: "Version only", Ciphertext: []byte{TokenVersion1}},
+		{Name: "Unknown version", Ciphertext: []byte{0xff, 0, 0}},
+		{Name: "Truncated version 2", Ciphertext: append([]byte{TokenVersion2, 0}, make([]byte, 27)...)},
+		{Name: "Truncated version 3", Ciphertext: append([]byte{TokenVersion3, 0}, make([]byte, 31)...)},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var token Token
+			assert.Error(t, token.Open(testCase.Ciphertext, secret))
+		})
+	}
+}
+
+func FuzzTokenOpen(f *testing.F) {
+	secret := make([]byte, 32)
+
+	userAgentPrivateKey, err := ecdh.P256().NewPrivateKey(append(make([]byte, 31), 1))
+	require.NoError(f, err)
+
+	for _, version := range []uint8{TokenVersion1, TokenVersion2, TokenVersion3} {
+		token := Token{
+			Version:                    version,
+			SubscriptionID:             uuid.UUID{1},
+			CreatedAt:                  time.Unix(1739707200, 0).UTC(),
+			ApplicationServerPublicKey: userAgentPrivateKey.PublicKey(),
+			UserAgentPrivateKey:        userAgentPrivateKey,
+			AuthenticationSecret:       make([]byte, 16),
+		}
+
+		ciphertext, err := token.Seal(secret)
+		require.NoError(f, err)
+		f.Add(ciphertext)
+	}
+	f.Add([]byte{})
+	f.Add([]byte{TokenVersion3})
+
+	f.Fuzz(func(t *testing.T, ciphertext []byte) {
+		var token Token
+		if err := token.Open(ciphertext, secret); err != nil {
+			return
+		}
+
+		// Version 3 tokens are deterministic
+		if token.Version == TokenVersion3 {
+			sealed, err := token.Seal(secret)
+			require.NoError(t, err)
+			assert.Equal(t, ciphertext, sealed)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+var _ Sink = (*WebhookSink)(nil)
+
+// WebhookSink delivers messages to a webhook, posting the JSON encoding of
+// each [Message].
+type WebhookSink struct {
+	// URL is the URL of the webhook.
+	URL string `json:"url"`
+	// Headers holds additional headers to send, such as Authorization.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Validate implements Sink.
+func (s *WebhookSink) Validate(agent *Agent) error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("webhook: url must be an absolute http or https URL")
+	}
+
+	return nil
+}
+
+// Deliver implements Sink.
+// Any 2xx response is considered successful.
+func (s *WebhookSink) Deliver(ctx context.Context, agent *Agent, message *Message) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	for name, value := range s.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := agent.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook: unexpected status code: %d", res.StatusCode)
+	}
+
+	return nil
+}
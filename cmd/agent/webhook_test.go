@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookSinkDeliver(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan map[string]any, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		requests <- r
+		bodies <- body
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink := &WebhookSink{
+		URL:     server.URL + "/hook",
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	}
+	require.NoError(t, sink.Validate(&Agent{}))
+
+	message := &Message{
+		SubscriptionID: uuid.MustParse("5b9f2c4e-7e0a-4c36-9a55-3b8f0f0e8a1d"),
+		Urgency:        webpush.UrgencyHigh,
+		ContentType:    "text/plain",
+		Content:        []byte("Hello, World!"),
+	}
+
+	require.NoError(t, sink.Deliver(context.TODO(), &Agent{Client: server.Client()}, message))
+
+	request := <-requests
+	assert.Equal(t, "/hook", request.URL.Path)
+	assert.Equal(t, "Bearer token", request.Header.Get("Authorization"))
+	assert.Equal(t, "application/json", request.Header.Get("Content-Type"))
+
+	assert.Equal(t, map[string]any{
+		"subscriptionId": "5b9f2c4e-7e0a-4c36-9a55-3b8f0f0e8a1d",
+		"urgency":        "high",
+		"contentType":    "text/plain",
+		"content":        "SGVsbG8sIFdvcmxkIQ==",
+	}, <-bodies)
+}
+
+func TestWebhookSinkDeliverError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	sink := &WebhookSink{URL: server.URL}
+
+	err := sink.Deliver(context.TODO(), &Agent{Client: server.Client()}, &Message{})
+	assert.ErrorContains(t, err, "502")
+}
+
+func TestWebhookSinkValidate(t *testing.T) {
+	assert.NoError(t, (&WebhookSink{URL: "https://example.com/hook"}).Validate(&Agent{}))
+	assert.Error(t, (&WebhookSink{URL: "/hook"}).Validate(&Agent{}))
+	assert.Error(t, (&WebhookSink{URL: "file:///etc/passwd"}).Validate(&Agent{}))
+}
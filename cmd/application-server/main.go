@@ -2,7 +2,7 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log/slog"
 	"net/http"
 
@@ -35,19 +35,10 @@ func main() {
 			return
 		}
 
-		message := webpush.DeclerativePushMessage{
-			WebPush: 8030,
-			Notification: webpush.DeclerativePushNotification{
-				Title:    request.Message,
-				Navigate: "https://example.com",
-			},
+		notification := webpush.DeclerativePushNotification{
+			Title:    request.Message,
+			Navigate: "https://example.com",
 		}
-		content, err := json.Marshal(&message)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		fmt.Printf("%s\n", content)
 
 		target, err := request.Subscription.PushTarget()
 		if err != nil {
@@ -56,13 +47,16 @@ func main() {
 		}
 
 		pushOptions := &webpush.PushOptions{
-			TTL:         3600,
-			Urgency:     webpush.UrgencyHigh,
-			ContentType: "application/notification+json",
+			TTL:     3600,
+			Urgency: webpush.UrgencyHigh,
 		}
 
-		err = applicationServer.Push(r.Context(), target, content, pushOptions)
-		if err != nil {
+		err = applicationServer.PushNotification(r.Context(), target, notification, pushOptions)
+		var validationErrors webpush.ValidationErrors
+		if errors.As(err, &validationErrors) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"crypto/ecdh"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log/slog"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/AlexGustafsson/web-push-poc/internal/autoconnect"
@@ -16,38 +20,97 @@ import (
 func main() {
 	slog.SetLogLoggerLevel(slog.LevelDebug)
 
-	if len(os.Args) != 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <application server public key>\n", os.Args[0])
+	url := flag.String("url", "wss://push.services.mozilla.com/", "URL of the autoconnect service")
+	storePath := flag.String("store", "", "path to a file in which to persist subscriptions. The passphrase is read from AUTOCONNECT_CLIENT_PASSPHRASE. The UAID is persisted next to it")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <application server public key>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	client, err := autoconnect.NewClient("wss://push.services.mozilla.com/")
-	if err != nil {
-		slog.Error("Failed to connect to push service", slog.Any("error", err))
-		return
+	var store webpush.SubscriptionStore
+	if *storePath == "" {
+		store = webpush.NewMemorySubscriptionStore()
+	} else {
+		passphrase := os.Getenv("AUTOCONNECT_CLIENT_PASSPHRASE")
+		if passphrase == "" {
+			slog.Error("AUTOCONNECT_CLIENT_PASSPHRASE must be set when using a store")
+			os.Exit(1)
+		}
+
+		fileStore, err := webpush.NewFileSubscriptionStore(*storePath, passphrase)
+		if err != nil {
+			slog.Error("Failed to open subscription store", slog.Any("error", err))
+			os.Exit(1)
+		}
+		store = fileStore
 	}
 
-	pushManager := webpush.NewPushManager(client)
-	client.OnMessage(func(m autoconnect.Message) {
-		switch m := m.(type) {
-		case *autoconnect.NotificationMessage:
-			data, err := base64.RawURLEncoding.DecodeString(m.Data)
-			if err != nil {
-				slog.Warn("Got invalid message body", slog.Any("error", err))
-				return
-			}
-
-			message, err := pushManager.HandleMessage(m.ChannelID, data)
-			if err != nil {
-				slog.Warn("Failed to handle message", slog.Any("error", err))
-				return
-			}
-
-			slog.Info("Got message", slog.String("message", string(message)))
+	// Resume the previous session, if any, so that stored subscriptions keep
+	// receiving messages
+	var uaidPath, uaid string
+	if *storePath != "" {
+		uaidPath = *storePath + ".uaid"
+
+		content, err := os.ReadFile(uaidPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("Failed to read UAID", slog.Any("error", err))
+			os.Exit(1)
 		}
+		uaid = strings.TrimSpace(string(content))
+	}
+
+	subscriptions, err := store.List()
+	if err != nil {
+		slog.Error("Failed to read subscriptions", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	channels := make(map[string]string, len(subscriptions))
+	for _, subscription := range subscriptions {
+		channels[subscription.ID] = subscription.Keys.P256DH
+	}
+
+	client := autoconnect.NewClient(*url, uaid, channels)
+	defer client.Close()
+
+	pushManager := webpush.NewPushManager(client, store)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+
+	// Subscriptions change when the service assigns a new UAID
+	pushManager.OnSubscriptionChange(func(change webpush.SubscriptionChange) {
+		slog.Info("Subscription changed", slog.String("subscriptionId", change.New.ID))
+		encoder.Encode(change.New)
+		saveUAID(uaidPath, client.UAID())
 	})
 
-	applicationServerPublicKeyBytes, err := base64.RawURLEncoding.DecodeString(os.Args[1])
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	messages := pushManager.Messages(ctx)
+	go func() {
+		for event := range messages {
+			slog.Info("Got message", slog.String("subscriptionId", event.SubscriptionID), slog.String("message", string(event.Content)))
+		}
+	}()
+
+	// Renew subscriptions before they expire, if the service expires them
+	go pushManager.Run(ctx)
+
+	if err := client.Connect(); err != nil {
+		slog.Error("Failed to connect to push service", slog.Any("error", err))
+		return
+	}
+	saveUAID(uaidPath, client.UAID())
+
+	applicationServerPublicKeyBytes, err := base64.RawURLEncoding.DecodeString(flag.Arg(0))
 	if err != nil {
 		slog.Error("Invalid server key", slog.Any("error", err))
 		return
@@ -65,9 +128,18 @@ func main() {
 		return
 	}
 
-	encoder := json.NewEncoder(os.Stdout)
-	encoder.SetIndent("", "  ")
 	encoder.Encode(subscription)
 
-	<-time.After(5 * time.Minute)
+	<-ctx.Done()
+}
+
+// saveUAID persists the UAID, if a path is set.
+func saveUAID(path string, uaid string) {
+	if path == "" {
+		return
+	}
+
+	if err := os.WriteFile(path, []byte(uaid+"\n"), 0o600); err != nil {
+		slog.Error("Failed to persist UAID", slog.Any("error", err))
+	}
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/autoconnect"
+)
+
+// ControlServer serves a local HTTP API for controlling a [Proxy].
+//
+//	GET  /rules                                    - list rules
+//	PUT  /rules                                    - replace rules
+//	GET  /connections                              - list connected user agents
+//	POST /connections/{connectionId}/notifications - inject a notification
+type ControlServer struct {
+	proxy *Proxy
+	mux   *http.ServeMux
+}
+
+// NewControlServer creates a new [ControlServer] controlling proxy.
+func NewControlServer(proxy *Proxy) *ControlServer {
+	server := &ControlServer{
+		proxy: proxy,
+		mux:   http.NewServeMux(),
+	}
+
+	server.mux.HandleFunc("GET /rules", server.getRules)
+	server.mux.HandleFunc("PUT /rules", server.putRules)
+	server.mux.HandleFunc("GET /connections", server.getConnections)
+	server.mux.HandleFunc("POST /connections/{connectionId}/notifications", server.postNotification)
+
+	return server
+}
+
+func (s *ControlServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *ControlServer) getRules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.proxy.Rules.Get())
+}
+
+func (s *ControlServer) putRules(w http.ResponseWriter, r *http.Request) {
+	var rules []*Rule
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.proxy.Rules.Set(rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *ControlServer) getConnections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.proxy.Connections())
+}
+
+func (s *ControlServer) postNotification(w http.ResponseWriter, r *http.Request) {
+	var notification autoconnect.NotificationMessage
+	if err := json.NewDecoder(r.Body).Decode(&notification); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if notification.ChannelID == "" {
+		http.Error(w, "missing channelID", http.StatusBadRequest)
+		return
+	}
+
+	err := s.proxy.Inject(r.PathValue("connectionId"), &notification)
+	if errors.Is(err, ErrConnectionNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.Error("Failed to inject notification", slog.Any("error", err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, &notification)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
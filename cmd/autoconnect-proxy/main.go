@@ -1,84 +1,181 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"flag"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
 )
 
+// shutdownTimeout is the time to wait for connections to close on shutdown.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
-	upgrader := &websocket.Upgrader{
-		Subprotocols: []string{},
+	address := flag.String("address", envOrDefault("AUTOCONNECT_PROXY_ADDRESS", ":8080"), "address to listen on (AUTOCONNECT_PROXY_ADDRESS)")
+	upstream := flag.String("upstream", envOrDefault("AUTOCONNECT_PROXY_UPSTREAM", "wss://push.services.mozilla.com/"), "URL of the upstream autoconnect service (AUTOCONNECT_PROXY_UPSTREAM)")
+	certFile := flag.String("cert", envOrDefault("AUTOCONNECT_PROXY_CERT", "localhost.pem"), "TLS certificate file (AUTOCONNECT_PROXY_CERT)")
+	keyFile := flag.String("key", envOrDefault("AUTOCONNECT_PROXY_KEY", "localhost-key.pem"), "TLS key file (AUTOCONNECT_PROXY_KEY)")
+	selfSigned := flag.Bool("self-signed", envBool("AUTOCONNECT_PROXY_SELF_SIGNED"), "serve TLS using a generated self-signed certificate for localhost (AUTOCONNECT_PROXY_SELF_SIGNED)")
+	plain := flag.Bool("plain", envBool("AUTOCONNECT_PROXY_PLAIN"), "serve plain WebSockets, without TLS (AUTOCONNECT_PROXY_PLAIN)")
+	forwardHeaders := flag.String("forward-headers", envOrDefault("AUTOCONNECT_PROXY_FORWARD_HEADERS", "User-Agent"), "comma-separated names of request headers to forward upstream (AUTOCONNECT_PROXY_FORWARD_HEADERS)")
+	recordPath := flag.String("record", "", "path to a JSONL file in which to record sessions")
+	replayPath := flag.String("replay", "", "path to a recorded session to play back instead of connecting upstream")
+	endpoint := flag.String("endpoint", "", "base URL of push endpoints to rewrite registrations to, such as https://localhost:8080/push. Messages pushed to them are injected as notifications")
+	endpointsPath := flag.String("endpoints", envOrDefault("AUTOCONNECT_PROXY_ENDPOINTS", ""), "path to a JSON file in which to persist rewritten push endpoints, keeping them working across restarts (AUTOCONNECT_PROXY_ENDPOINTS)")
+	rulesPath := flag.String("rules", envOrDefault("AUTOCONNECT_PROXY_RULES", ""), "path to a JSON file holding rules to apply to frames (AUTOCONNECT_PROXY_RULES)")
+	controlAddress := flag.String("control", envOrDefault("AUTOCONNECT_PROXY_CONTROL", ""), "address to serve the control API on, such as 127.0.0.1:8081 (AUTOCONNECT_PROXY_CONTROL)")
+	flag.Parse()
+
+	proxy := NewProxy(*upstream)
+	proxy.ForwardHeaders = nil
+	for _, name := range strings.Split(*forwardHeaders, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			proxy.ForwardHeaders = append(proxy.ForwardHeaders, name)
+		}
 	}
 
-	http.ListenAndServeTLS(":8080", "localhost.pem", "localhost-key.pem", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
+	if *recordPath != "" {
+		recorder, err := NewRecorder(*recordPath)
 		if err != nil {
-			slog.Error("Failed to upgrade WebSocket", slog.Any("error", err))
-			return
+			slog.Error("Failed to open session log", slog.Any("error", err))
+			os.Exit(1)
 		}
+		defer recorder.Close()
+		proxy.Recorder = recorder
+	}
 
-		requestHeader := http.Header{
-			"User-Agent": r.Header["User-Agent"],
+	if *replayPath != "" {
+		connections, err := ReadSession(*replayPath)
+		if err != nil {
+			slog.Error("Failed to read session log", slog.Any("error", err))
+			os.Exit(1)
 		}
+		proxy.Replayer = NewReplayer(connections)
+	}
 
-		proxy(conn, requestHeader)
-	}))
-}
+	if *rulesPath != "" {
+		rules, err := LoadRules(*rulesPath)
+		if err == nil {
+			err = proxy.Rules.Set(rules)
+		}
+		if err != nil {
+			slog.Error("Failed to load rules", slog.Any("error", err))
+			os.Exit(1)
+		}
+	}
 
-func proxy(conn *websocket.Conn, requestHeader http.Header) {
+	mux := http.NewServeMux()
+	if *endpoint != "" {
+		if *endpointsPath != "" {
+			rewriter, err := OpenEndpointRewriter(*endpoint, *endpointsPath)
+			if err != nil {
+				slog.Error("Failed to open rewritten endpoints", slog.Any("error", err))
+				os.Exit(1)
+			}
+			proxy.Rewriter = rewriter
+		} else {
+			proxy.Rewriter = NewEndpointRewriter(*endpoint)
+		}
+		mux.Handle("/push/", webpush.NewPushServer(proxy.Rewriter))
+	}
+	mux.Handle("/", proxy)
 
-	upstream, _, err := websocket.DefaultDialer.Dial("wss://push.services.mozilla.com/", requestHeader)
-	if err != nil {
-		slog.Error("Failed to connect to upstream", slog.Any("error", err))
-		conn.Close()
-		return
+	server := &http.Server{
+		Addr:    *address,
+		Handler: mux,
 	}
 
-	// conn -> upstrean
-	go func() {
-		defer upstream.Close()
+	if *selfSigned && !*plain {
+		certificate, fingerprint, err := generateCertificate([]string{"localhost", "127.0.0.1", "::1"})
+		if err != nil {
+			slog.Error("Failed to generate certificate", slog.Any("error", err))
+			os.Exit(1)
+		}
+		slog.Info("Generated self-signed certificate", slog.String("sha256", fingerprint))
 
-		for {
-			messageType, message, err := conn.ReadMessage()
-			if err != nil {
-				slog.Error("Failed to read message", slog.Any("error", err))
-				return
-			}
+		server.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+		}
+		*certFile = ""
+		*keyFile = ""
+	}
 
-			fmt.Fprintln(os.Stderr, "Firefox -> Server")
-			fmt.Fprintf(os.Stdout, "%s\n", message)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-			err = upstream.WriteMessage(messageType, message)
-			if err != nil {
-				slog.Error("Failed to send message", slog.Any("error", err))
-				return
-			}
+	errs := make(chan error, 2)
+	go func() {
+		slog.Info("Listening", slog.String("address", *address), slog.String("upstream", *upstream))
+		if *plain {
+			errs <- server.ListenAndServe()
+		} else {
+			errs <- server.ListenAndServeTLS(*certFile, *keyFile)
 		}
 	}()
 
-	// conn <- upstream
-	go func() {
-		defer conn.Close()
+	var controlServer *http.Server
+	if *controlAddress != "" {
+		controlServer = &http.Server{
+			Addr:    *controlAddress,
+			Handler: NewControlServer(proxy),
+		}
 
-		for {
-			messageType, message, err := upstream.ReadMessage()
-			if err != nil {
-				slog.Error("Failed to read message", slog.Any("error", err))
-				return
-			}
+		go func() {
+			slog.Info("Serving control API", slog.String("address", *controlAddress))
+			errs <- controlServer.ListenAndServe()
+		}()
+	}
 
-			fmt.Fprintln(os.Stderr, "Firefox <- Server")
-			fmt.Fprintf(os.Stdout, "%s\n", message)
+	select {
+	case err := <-errs:
+		slog.Error("Failed to serve", slog.Any("error", err))
+		if proxy.Recorder != nil {
+			proxy.Recorder.Close()
+		}
+		os.Exit(1)
+	case <-ctx.Done():
+	}
 
-			err = conn.WriteMessage(messageType, message)
-			if err != nil {
-				slog.Error("Failed to send message", slog.Any("error", err))
-				return
-			}
+	slog.Info("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to shut down server", slog.Any("error", err))
+	}
+
+	if controlServer != nil {
+		if err := controlServer.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Failed to shut down control server", slog.Any("error", err))
 		}
-	}()
+	}
+
+	if err := proxy.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Closed lingering connections", slog.Any("error", err))
+	}
+}
+
+// envOrDefault returns the value of the environment variable, or value if the
+// variable is unset or empty.
+func envOrDefault(name string, value string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return value
+}
+
+// envBool returns true if the environment variable is set to a true value.
+func envBool(name string) bool {
+	value, _ := strconv.ParseBool(os.Getenv(name))
+	return value
 }
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/autoconnect"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Proxy proxies connections from user agents to an upstream autoconnect
+// service.
+type Proxy struct {
+	// Upstream is the URL of the upstream autoconnect service.
+	Upstream string
+	// ForwardHeaders are the names of request headers forwarded upstream.
+	ForwardHeaders []string
+	// Recorder, if set, records all frames.
+	Recorder *Recorder
+	// Replayer, if set, plays back recorded sessions instead of connecting
+	// upstream.
+	Replayer *Replayer
+	// Rewriter tracks injected notifications and, if configured with an
+	// endpoint, rewrites push endpoints.
+	Rewriter *EndpointRewriter
+	// Rules are applied to all proxied frames.
+	Rules *Rules
+
+	upgrader websocket.Upgrader
+
+	mutex   sync.Mutex
+	closing bool
+	// connections maps connection IDs to connections.
+	connections map[string]*Connection
+	wg          sync.WaitGroup
+}
+
+// Connection is a connected user agent.
+type Connection struct {
+	ID          string    `json:"id"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	ConnectedAt time.Time `json:"connectedAt"`
+
+	downstream *Downstream
+	// cancel ends the connection's session.
+	cancel context.CancelFunc
+}
+
+// ErrConnectionNotFound is returned when a connection does not exist.
+var ErrConnectionNotFound = errors.New("connection not found")
+
+// NewProxy creates a new [Proxy] connecting to upstream.
+func NewProxy(upstream string) *Proxy {
+	return &Proxy{
+		Upstream:       upstream,
+		ForwardHeaders: []string{"User-Agent"},
+		Rewriter:       NewEndpointRewriter(""),
+		Rules:          &Rules{},
+
+		connections: make(map[string]*Connection),
+	}
+}
+
+// ServeHTTP serves the autoconnect WebSocket.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	if p.closing {
+		p.mutex.Unlock()
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	p.wg.Add(1)
+	p.mutex.Unlock()
+	defer p.wg.Done()
+
+	conn, err := p.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Error("Failed to upgrade WebSocket", slog.Any("error", err))
+		return
+	}
+	defer conn.Close()
+
+	connectionID := uuid.NewString()
+	logger := slog.With(slog.String("connectionId", connectionID))
+	logger.Info("User agent connected", slog.String("remoteAddr", r.RemoteAddr))
+	defer logger.Info("User agent disconnected")
+
+	logFrame := func(direction Direction, message []byte) {
+		if direction == DirectionUpstream {
+			fmt.Fprintf(os.Stderr, "[%s] Firefox -> Server\n", connectionID)
+		} else {
+			fmt.Fprintf(os.Stderr, "[%s] Firefox <- Server\n", connectionID)
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", message)
+
+		if p.Recorder != nil {
+			if err := p.Recorder.Record(NewFrame(connectionID, direction, message)); err != nil {
+				logger.Error("Failed to record frame", slog.Any("error", err))
+			}
+		}
+	}
+
+	downstream := NewDownstream(conn, logFrame)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p.mutex.Lock()
+	p.connections[connectionID] = &Connection{
+		ID:          connectionID,
+		RemoteAddr:  r.RemoteAddr,
+		ConnectedAt: time.Now(),
+
+		downstream: downstream,
+		cancel:     cancel,
+	}
+	p.mutex.Unlock()
+	defer func() {
+		p.mutex.Lock()
+		delete(p.connections, connectionID)
+		p.mutex.Unlock()
+	}()
+
+	if p.Replayer != nil {
+		if err := p.Replayer.Replay(downstream); err != nil {
+			logger.Error("Failed to replay session", slog.Any("error", err))
+		}
+		return
+	}
+
+	requestHeader := make(http.Header)
+	for _, name := range p.ForwardHeaders {
+		if values := r.Header.Values(name); len(values) > 0 {
+			requestHeader[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	p.proxy(ctx, logger, downstream, requestHeader)
+}
+
+// proxy proxies a connection to upstream until either side closes it or ctx
+// is done.
+func (p *Proxy) proxy(ctx context.Context, logger *slog.Logger, downstream *Downstream, requestHeader http.Header) {
+	upstream, _, err := websocket.DefaultDialer.DialContext(ctx, p.Upstream, requestHeader)
+	if err != nil {
+		logger.Error("Failed to connect to upstream", slog.Any("error", err))
+		return
+	}
+
+	conn := downstream.conn
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Close both sides once either is done, unblocking reads
+	go func() {
+		<-ctx.Done()
+		upstream.Close()
+		conn.Close()
+	}()
+
+	if p.Rewriter != nil {
+		defer p.Rewriter.Disconnect(downstream)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// conn -> upstream
+	go func() {
+		defer wg.Done()
+		defer cancel()
+
+		read := func() (int, []byte, error) {
+			for {
+				messageType, message, err := conn.ReadMessage()
+				if err != nil {
+					return 0, nil, err
+				}
+
+				downstream.logFrame(DirectionUpstream, message)
+
+				if p.Rewriter == nil {
+					return messageType, message, nil
+				}
+
+				if message, ok := p.Rewriter.RewriteUpstream(downstream, message); ok {
+					return messageType, message, nil
+				}
+			}
+		}
+
+		p.pump(ctx, logger, DirectionUpstream, read, upstream.WriteMessage)
+	}()
+
+	// conn <- upstream
+	go func() {
+		defer wg.Done()
+		defer cancel()
+
+		write := downstream.WriteMessage
+		if p.Rewriter != nil {
+			write = func(messageType int, data []byte) error {
+				return p.Rewriter.WriteDownstream(downstream, messageType, data)
+			}
+		}
+
+		p.pump(ctx, logger, DirectionDownstream, upstream.ReadMessage, write)
+	}()
+
+	wg.Wait()
+}
+
+// frameQueueSize is the number of frames read ahead of delayed frames.
+const frameQueueSize = 64
+
+// delayedFrames are frames to send in place of a proxied frame once delayed.
+type delayedFrames struct {
+	messageType int
+	frames      [][]byte
+	delay       time.Duration
+}
+
+// pump reads frames using read, applies the rules of direction and sends the
+// resulting frames using write. Delayed frames are sent in order by a separate
+// goroutine, so that reading, including handling of pings, is not held up.
+// Returns once reading or sending fails, or ctx is done.
+func (p *Proxy) pump(ctx context.Context, logger *slog.Logger, direction Direction, read func() (int, []byte, error), write func(int, []byte) error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make(chan delayedFrames, frameQueueSize)
+
+	go func() {
+		defer cancel()
+
+		for {
+			var frames delayedFrames
+			select {
+			case frames = <-queue:
+			case <-ctx.Done():
+				return
+			}
+
+			if !wait(ctx, frames.delay) {
+				return
+			}
+
+			for _, frame := range frames.frames {
+				if err := write(frames.messageType, frame); err != nil {
+					logger.Error("Failed to send message", slog.Any("error", err))
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		messageType, message, err := read()
+		if err != nil {
+			logger.Debug("Failed to read message", slog.Any("error", err))
+			return
+		}
+
+		frames, delay := p.Rules.Apply(direction, message)
+
+		select {
+		case queue <- delayedFrames{messageType: messageType, frames: frames, delay: delay}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// wait waits for delay to pass. Returns false if ctx is done first.
+func wait(ctx context.Context, delay time.Duration) bool {
+	if delay <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Connections returns all connected user agents.
+func (p *Proxy) Connections() []*Connection {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	connections := make([]*Connection, 0, len(p.connections))
+	for _, connection := range p.connections {
+		connections = append(connections, connection)
+	}
+
+	slices.SortFunc(connections, func(a, b *Connection) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+
+	return connections
+}
+
+// Inject sends a notification to a connected user agent. The notification's
+// version is generated if empty. Acks and nacks of the notification are not
+// forwarded upstream.
+func (p *Proxy) Inject(connectionID string, notification *autoconnect.NotificationMessage) error {
+	p.mutex.Lock()
+	connection, ok := p.connections[connectionID]
+	p.mutex.Unlock()
+	if !ok {
+		return ErrConnectionNotFound
+	}
+
+	notification.MessageType = "notification"
+	if notification.Version == "" {
+		notification.Version = uuid.NewString()
+	}
+
+	// Injected notifications are only delivered while connected
+	if p.Rewriter != nil {
+		return p.Rewriter.Inject(connection.downstream, notification, 0)
+	}
+
+	return connection.downstream.WriteNotification(notification)
+}
+
+// Shutdown asks all connected user agents to go away and waits for their
+// connections to close. Connections still open once ctx is done are closed.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.mutex.Lock()
+	p.closing = true
+	for _, connection := range p.connections {
+		connection.downstream.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+	}
+	p.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		p.mutex.Lock()
+		for _, connection := range p.connections {
+			connection.cancel()
+			connection.downstream.conn.Close()
+		}
+		p.mutex.Unlock()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/autoconnect"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy(t *testing.T) {
+	var userAgent, cookie string
+
+	upstreamMux := http.NewServeMux()
+	upstreamServer := httptest.NewServer(upstreamMux)
+	defer upstreamServer.Close()
+
+	upstream := autoconnect.NewServer(upstreamServer.URL + "/push")
+	upstreamMux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		cookie = r.Header.Get("Cookie")
+		upstream.ServeHTTP(w, r)
+	}))
+
+	proxy := NewProxy("ws" + strings.TrimPrefix(upstreamServer.URL, "http"))
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	conn, err := autoconnect.Dial("ws" + strings.TrimPrefix(proxyServer.URL, "http"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = conn.Send(ctx, &autoconnect.HelloMessageRequest{MessageType: "hello", UseWebPush: true})
+	require.NoError(t, err)
+
+	// Only the configured headers are forwarded
+	assert.Equal(t, "Go-http-client/1.1", userAgent)
+	assert.Empty(t, cookie)
+
+	response, err := conn.Send(ctx, &autoconnect.RegisterMessageRequest{MessageType: "register", ChannelID: "a8c1d7a6-5e0b-4a57-9a4a-3f1c0f6b1f7e"})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(response.(*autoconnect.RegisterMessageResponse).PushEndpoint, upstreamServer.URL+"/push/"))
+
+	// User agents are asked to go away on shutdown
+	require.NoError(t, proxy.Shutdown(ctx))
+
+	select {
+	case <-conn.Done():
+	case <-ctx.Done():
+		require.FailNow(t, "timed out waiting for connection to close")
+	}
+}
+
+func TestProxyControl(t *testing.T) {
+	upstreamMux := http.NewServeMux()
+	upstreamServer := httptest.NewServer(upstreamMux)
+	defer upstreamServer.Close()
+	upstreamMux.Handle("/", autoconnect.NewServer(upstreamServer.URL+"/push"))
+
+	proxy := NewProxy("ws" + strings.TrimPrefix(upstreamServer.URL, "http"))
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	controlServer := httptest.NewServer(NewControlServer(proxy))
+	defer controlServer.Close()
+
+	// Drop the first register response
+	req, err := http.NewRequest(http.MethodPut, controlServer.URL+"/rules", strings.NewReader(`[{"direction":"downstream","messageType":"register","action":"drop","times":1}]`))
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	conn, err := autoconnect.Dial("ws" + strings.TrimPrefix(proxyServer.URL, "http"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	notifications := make(chan autoconnect.Message, 1)
+	conn.OnMessage(func(message autoconnect.Message) {
+		notifications <- message
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	hello, err := conn.Send(ctx, &autoconnect.HelloMessageRequest{MessageType: "hello", UseWebPush: true})
+	require.NoError(t, err)
+	uaid := hello.(*autoconnect.HelloMessageResponse).UAID
+
+	register := &autoconnect.RegisterMessageRequest{MessageType: "register", ChannelID: "a8c1d7a6-5e0b-4a57-9a4a-3f1c0f6b1f7e"}
+	dropCtx, dropCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	_, err = conn.Send(dropCtx, register)
+	dropCancel()
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = conn.Send(ctx, register)
+	require.NoError(t, err)
+
+	// Inject a notification into the connection
+	res, err = http.Get(controlServer.URL + "/connections")
+	require.NoError(t, err)
+	var connections []*Connection
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&connections))
+	res.Body.Close()
+	require.Len(t, connections, 1)
+
+	res, err = http.Post(controlServer.URL+"/connections/"+connections[0].ID+"/notifications", "application/json", strings.NewReader(`{"channelID":"a8c1d7a6-5e0b-4a57-9a4a-3f1c0f6b1f7e"}`))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+
+	select {
+	case message := <-notifications:
+		notification := message.(*autoconnect.NotificationMessage)
+		assert.Equal(t, "a8c1d7a6-5e0b-4a57-9a4a-3f1c0f6b1f7e", notification.ChannelID)
+		assert.NotEmpty(t, notification.Version)
+
+		// The ack of the injected notification is not forwarded upstream
+		err = conn.Write(&autoconnect.AckMessageRequest{
+			MessageType: "ack",
+			Updates:     []autoconnect.AckUpdate{{ChannelID: notification.ChannelID, Version: notification.Version, Code: autoconnect.AckCodeDelivered}},
+		})
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			proxy.Rewriter.mutex.Lock()
+			defer proxy.Rewriter.mutex.Unlock()
+			return proxy.Rewriter.pending[uaid].Len() == 0
+		}, 5*time.Second, 10*time.Millisecond)
+	case <-ctx.Done():
+		require.FailNow(t, "timed out waiting for notification")
+	}
+
+	res, err = http.Post(controlServer.URL+"/connections/unknown/notifications", "application/json", strings.NewReader(`{"channelID":"a8c1d7a6-5e0b-4a57-9a4a-3f1c0f6b1f7e"}`))
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestProxyShutdownDelayed(t *testing.T) {
+	upstreamMux := http.NewServeMux()
+	upstreamServer := httptest.NewServer(upstreamMux)
+	defer upstreamServer.Close()
+	upstreamMux.Handle("/", autoconnect.NewServer(upstreamServer.URL+"/push"))
+
+	proxy := NewProxy("ws" + strings.TrimPrefix(upstreamServer.URL, "http"))
+	require.NoError(t, proxy.Rules.Set([]*Rule{{Direction: DirectionDownstream, MessageType: "register", Action: ActionDelay, Delay: Duration(time.Hour)}}))
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	conn, err := autoconnect.Dial("ws" + strings.TrimPrefix(proxyServer.URL, "http"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = conn.Send(ctx, &autoconnect.HelloMessageRequest{MessageType: "hello", UseWebPush: true})
+	require.NoError(t, err)
+
+	// The response is held for an hour
+	require.NoError(t, conn.Write(&autoconnect.RegisterMessageRequest{MessageType: "register", ChannelID: "a8c1d7a6-5e0b-4a57-9a4a-3f1c0f6b1f7e"}))
+
+	// Delays don't hold up shutdown
+	require.NoError(t, proxy.Shutdown(ctx))
+	assert.Empty(t, proxy.Connections())
+}
+
+func TestGenerateCertificate(t *testing.T) {
+	certificate, fingerprint, err := generateCertificate([]string{"localhost", "127.0.0.1"})
+	require.NoError(t, err)
+	assert.Len(t, fingerprint, 64)
+
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	require.NoError(t, err)
+	assert.NoError(t, parsed.VerifyHostname("localhost"))
+	assert.NoError(t, parsed.VerifyHostname("127.0.0.1"))
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/autoconnect"
+	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+var _ webpush.Pusher = (*EndpointRewriter)(nil)
+
+// Downstream is the user agent's side of a proxied connection.
+type Downstream struct {
+	mutex    sync.Mutex
+	conn     *websocket.Conn
+	logFrame func(Direction, []byte)
+	// uaid is the UAID assigned by the upstream push service, once known.
+	uaid string
+}
+
+// NewDownstream creates a new [Downstream], logging each frame written.
+func NewDownstream(conn *websocket.Conn, logFrame func(Direction, []byte)) *Downstream {
+	return &Downstream{
+		conn:     conn,
+		logFrame: logFrame,
+	}
+}
+
+// WriteMessage writes a frame to the user agent.
+func (d *Downstream) WriteMessage(messageType int, data []byte) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.logFrame(DirectionDownstream, data)
+	return d.conn.WriteMessage(messageType, data)
+}
+
+// WriteNotification writes a notification to the user agent.
+func (d *Downstream) WriteNotification(message *autoconnect.NotificationMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	return d.WriteMessage(websocket.TextMessage, data)
+}
+
+// EndpointRewriter rewrites the push endpoints of registrations to point at
+// its own push endpoints, making the proxy act as a hybrid push service.
+// Messages sent to the upstream push endpoints are proxied as usual, messages
+// pushed to the rewritten endpoints are injected into the user agent's
+// connection as notifications.
+// EndpointRewriter implements [webpush.Pusher] and is meant to be used with a
+// [webpush.PushServer] serving the rewritten endpoints.
+// Without an endpoint, push endpoints are left as is and EndpointRewriter only
+// tracks notifications injected using [EndpointRewriter.Inject].
+// Rewritten endpoints are persisted if created using [OpenEndpointRewriter],
+// all other state is kept in memory.
+type EndpointRewriter struct {
+	// Endpoint is the base URL of rewritten push endpoints, such as
+	// "https://example.com/push". Push endpoints are not rewritten if empty.
+	Endpoint string
+
+	// path is the file rewritten endpoints are persisted to, if any.
+	path string
+
+	mutex sync.Mutex
+	// endpoints maps tokens of rewritten push endpoints to registrations.
+	endpoints map[string]*rewrittenEndpoint
+	// tokens maps UAIDs and channel IDs to tokens.
+	tokens map[string]string
+	// connections maps UAIDs to connected user agents.
+	connections map[string]*Downstream
+	// pending maps UAIDs to injected notifications not yet acknowledged.
+	pending map[string]*autoconnect.Pending
+}
+
+type rewrittenEndpoint struct {
+	Token     string `json:"token"`
+	UAID      string `json:"uaid"`
+	ChannelID string `json:"channelID"`
+	// Upstream is the push endpoint assigned by the upstream push service.
+	Upstream string `json:"upstream"`
+}
+
+type endpointsFile struct {
+	Version   int                  `json:"version"`
+	Endpoints []*rewrittenEndpoint `json:"endpoints"`
+}
+
+// NewEndpointRewriter creates a new [EndpointRewriter] serving push endpoints
+// under endpoint.
+func NewEndpointRewriter(endpoint string) *EndpointRewriter {
+	return &EndpointRewriter{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+
+		endpoints:   make(map[string]*rewrittenEndpoint),
+		tokens:      make(map[string]string),
+		connections: make(map[string]*Downstream),
+		pending:     make(map[string]*autoconnect.Pending),
+	}
+}
+
+// OpenEndpointRewriter creates a new [EndpointRewriter] serving push endpoints
+// under endpoint, persisting rewritten endpoints to a JSON file at path.
+// Endpoints rewritten before a restart keep working once user agents resume
+// their sessions.
+func OpenEndpointRewriter(endpoint string, path string) (*EndpointRewriter, error) {
+	rewriter := NewEndpointRewriter(endpoint)
+	rewriter.path = path
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return rewriter, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var file endpointsFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+
+	if file.Version != 1 {
+		return nil, fmt.Errorf("unsupported endpoints file version")
+	}
+
+	for _, endpoint := range file.Endpoints {
+		rewriter.endpoints[endpoint.Token] = endpoint
+		rewriter.tokens[endpoint.UAID+"/"+endpoint.ChannelID] = endpoint.Token
+	}
+
+	return rewriter, nil
+}
+
+// write writes all rewritten endpoints to disk, if persisted. Must be called
+// with the mutex held.
+func (r *EndpointRewriter) write() error {
+	if r.path == "" {
+		return nil
+	}
+
+	file := endpointsFile{
+		Version:   1,
+		Endpoints: make([]*rewrittenEndpoint, 0, len(r.endpoints)),
+	}
+	for _, endpoint := range r.endpoints {
+		file.Endpoints = append(file.Endpoints, endpoint)
+	}
+
+	content, err := json.MarshalIndent(&file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it to not leave a partially written
+	// file behind
+	temp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(content); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), r.path)
+}
+
+// UpstreamEndpoint returns the upstream push endpoint of a rewritten push
+// endpoint's token.
+func (r *EndpointRewriter) UpstreamEndpoint(token string) (string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	endpoint, ok := r.endpoints[token]
+	if !ok {
+		return "", false
+	}
+
+	return endpoint.Upstream, true
+}
+
+// RewriteUpstream rewrites a frame sent by the user agent. Acks and nacks of
+// injected notifications are handled by the rewriter and not forwarded.
+// Returns false if the frame should be dropped.
+func (r *EndpointRewriter) RewriteUpstream(downstream *Downstream, data []byte) ([]byte, bool) {
+	var message map[string]json.RawMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return data, true
+	}
+
+	var messageType string
+	json.Unmarshal(message["messageType"], &messageType)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	pending := r.pending[downstream.uaid]
+
+	switch messageType {
+	case "ack":
+		if pending == nil {
+			return data, true
+		}
+
+		var updates []autoconnect.AckUpdate
+		if err := json.Unmarshal(message["updates"], &updates); err != nil {
+			return data, true
+		}
+
+		forwarded := make([]autoconnect.AckUpdate, 0, len(updates))
+		for _, update := range updates {
+			if !pending.Ack(update.ChannelID, update.Version) {
+				forwarded = append(forwarded, update)
+			}
+		}
+
+		if len(forwarded) == 0 {
+			return nil, false
+		} else if len(forwarded) == len(updates) {
+			return data, true
+		}
+
+		message["updates"], _ = json.Marshal(forwarded)
+		rewrittenData, err := json.Marshal(message)
+		if err != nil {
+			return data, true
+		}
+
+		return rewrittenData, true
+	case "nack":
+		var version string
+		json.Unmarshal(message["version"], &version)
+		if pending != nil && pending.Remove(version) {
+			slog.Warn("Injected notification was not handled", slog.String("version", version))
+			return nil, false
+		}
+	case "unregister":
+		var channelID string
+		json.Unmarshal(message["channelID"], &channelID)
+
+		key := downstream.uaid + "/" + channelID
+		if token, ok := r.tokens[key]; ok {
+			delete(r.tokens, key)
+			delete(r.endpoints, token)
+			if err := r.write(); err != nil {
+				slog.Error("Failed to persist rewritten endpoints", slog.Any("error", err))
+			}
+		}
+
+		if pending != nil {
+			pending.RemoveChannel(channelID)
+		}
+	}
+
+	return data, true
+}
+
+// WriteDownstream rewrites a frame sent by the upstream push service and writes
+// it to the user agent. Once the user agent is connected, pending injected
+// notifications are delivered.
+func (r *EndpointRewriter) WriteDownstream(downstream *Downstream, messageType int, data []byte) error {
+	data, connected := r.rewriteDownstream(downstream, data)
+
+	if err := downstream.WriteMessage(messageType, data); err != nil {
+		return err
+	}
+
+	if !connected {
+		return nil
+	}
+
+	var pending []*autoconnect.NotificationMessage
+	r.mutex.Lock()
+	if p, ok := r.pending[downstream.uaid]; ok {
+		pending = p.Messages(time.Now())
+	}
+	r.mutex.Unlock()
+
+	for _, message := range pending {
+		if err := downstream.WriteNotification(message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewriteDownstream rewrites a frame sent by the upstream push service.
+// Returns true if the frame is a successful hello response.
+func (r *EndpointRewriter) rewriteDownstream(downstream *Downstream, data []byte) ([]byte, bool) {
+	var message map[string]json.RawMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return data, false
+	}
+
+	var response struct {
+		MessageType  string `json:"messageType"`
+		UAID         string `json:"uaid"`
+		ChannelID    string `json:"channelID"`
+		Status       int    `json:"status"`
+		PushEndpoint string `json:"pushEndpoint"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil || response.Status != 200 {
+		return data, false
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch response.MessageType {
+	case "hello":
+		downstream.uaid = response.UAID
+		r.connections[response.UAID] = downstream
+		return data, true
+	case "register":
+		if r.Endpoint == "" {
+			return data, false
+		}
+
+		key := downstream.uaid + "/" + response.ChannelID
+		token, ok := r.tokens[key]
+		if !ok {
+			token = strings.ReplaceAll(uuid.NewString(), "-", "")
+			r.tokens[key] = token
+		}
+
+		if endpoint, ok := r.endpoints[token]; !ok || endpoint.Upstream != response.PushEndpoint {
+			r.endpoints[token] = &rewrittenEndpoint{
+				Token:     token,
+				UAID:      downstream.uaid,
+				ChannelID: response.ChannelID,
+				Upstream:  response.PushEndpoint,
+			}
+
+			if err := r.write(); err != nil {
+				slog.Error("Failed to persist rewritten endpoints", slog.Any("error", err))
+			}
+		}
+
+		message["pushEndpoint"], _ = json.Marshal(r.Endpoint + "/" + token)
+		rewrittenData, err := json.Marshal(message)
+		if err != nil {
+			return data, false
+		}
+
+		slog.Info("Rewrote push endpoint", slog.String("channelId", response.ChannelID), slog.String("upstream", response.PushEndpoint))
+		return rewrittenData, false
+	}
+
+	return data, false
+}
+
+// Disconnect forgets a user agent's connection. Notifications are kept until
+// the user agent reconnects.
+func (r *EndpointRewriter) Disconnect(downstream *Downstream) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.connections[downstream.uaid] == downstream {
+		delete(r.connections, downstream.uaid)
+	}
+}
+
+// Push implements webpush.Pusher.
+// Messages are kept until acknowledged by the user agent, or until their TTL
+// expires. Returns [webpush.ErrSubscriptionNotFound] for unknown tokens.
+func (r *EndpointRewriter) Push(request *webpush.PushRequest) error {
+	r.mutex.Lock()
+	endpoint, ok := r.endpoints[request.Token]
+	if !ok {
+		r.mutex.Unlock()
+		return webpush.ErrSubscriptionNotFound
+	}
+
+	message := autoconnect.NewNotification(endpoint.ChannelID, request)
+	r.hold(endpoint.UAID, message, request.TTL)
+	downstream := r.connections[endpoint.UAID]
+	r.mutex.Unlock()
+
+	if downstream == nil {
+		return nil
+	}
+
+	if err := downstream.WriteNotification(message); err != nil {
+		// The message is delivered when the user agent reconnects
+		slog.Warn("Failed to inject notification", slog.String("uaid", endpoint.UAID), slog.Any("error", err))
+	}
+
+	return nil
+}
+
+// Inject injects a notification into a user agent's connection. Like messages
+// pushed to rewritten endpoints, the notification is kept for ttl seconds
+// until acknowledged and its ack or nack is not forwarded upstream.
+func (r *EndpointRewriter) Inject(downstream *Downstream, message *autoconnect.NotificationMessage, ttl int) error {
+	r.mutex.Lock()
+	r.hold(downstream.uaid, message, ttl)
+	r.mutex.Unlock()
+
+	return downstream.WriteNotification(message)
+}
+
+// hold keeps a notification injected for a user agent until acknowledged.
+// Must be called with the mutex held.
+func (r *EndpointRewriter) hold(uaid string, message *autoconnect.NotificationMessage, ttl int) {
+	pending, ok := r.pending[uaid]
+	if !ok {
+		pending = &autoconnect.Pending{}
+		r.pending[uaid] = pending
+	}
+
+	pending.Add(message, ttl)
+}
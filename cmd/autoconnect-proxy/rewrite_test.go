@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/autoconnect"
+	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDownstream returns a downstream and the user agent's side of it.
+func newTestDownstream(t *testing.T) (*Downstream, *websocket.Conn) {
+	downstreams := make(chan *Downstream, 1)
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		downstreams <- NewDownstream(conn, func(Direction, []byte) {})
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return <-downstreams, conn
+}
+
+func readNotification(t *testing.T, conn *websocket.Conn) *autoconnect.NotificationMessage {
+	var message autoconnect.NotificationMessage
+	require.NoError(t, conn.ReadJSON(&message))
+	require.Equal(t, "notification", message.MessageType)
+	return &message
+}
+
+func TestEndpointRewriter(t *testing.T) {
+	rewriter := NewEndpointRewriter("https://localhost:8080/push/")
+	downstream, conn := newTestDownstream(t)
+
+	err := rewriter.WriteDownstream(downstream, websocket.TextMessage, []byte(`{"messageType":"hello","uaid":"a","status":200,"use_webpush":true}`))
+	require.NoError(t, err)
+	_, _, err = conn.ReadMessage()
+	require.NoError(t, err)
+
+	// Registrations point at the rewriter
+	err = rewriter.WriteDownstream(downstream, websocket.TextMessage, []byte(`{"messageType":"register","channelID":"1","status":200,"pushEndpoint":"https://updates.push.services.mozilla.com/wpush/v2/abc"}`))
+	require.NoError(t, err)
+
+	var register autoconnect.RegisterMessageResponse
+	require.NoError(t, conn.ReadJSON(&register))
+	require.True(t, strings.HasPrefix(register.PushEndpoint, "https://localhost:8080/push/"))
+
+	token := strings.TrimPrefix(register.PushEndpoint, "https://localhost:8080/push/")
+	upstream, ok := rewriter.UpstreamEndpoint(token)
+	require.True(t, ok)
+	assert.Equal(t, "https://updates.push.services.mozilla.com/wpush/v2/abc", upstream)
+
+	// Pushed messages are injected
+	err = rewriter.Push(&webpush.PushRequest{Token: token, TTL: 60, ContentType: "application/notification+json", ContentEncoding: "aes128gcm", Content: []byte("Hello, World!")})
+	require.NoError(t, err)
+
+	notification := readNotification(t, conn)
+	assert.Equal(t, "1", notification.ChannelID)
+	assert.Equal(t, "aes128gcm", notification.Headers["encoding"])
+	assert.Equal(t, "application/notification+json", notification.Headers["content_type"])
+
+	// Acks of injected notifications are not forwarded upstream, others are
+	ack, err := json.Marshal(&autoconnect.AckMessageRequest{
+		MessageType: "ack",
+		Updates: []autoconnect.AckUpdate{
+			{ChannelID: "1", Version: notification.Version, Code: autoconnect.AckCodeDelivered},
+			{ChannelID: "1", Version: "upstream", Code: autoconnect.AckCodeDelivered},
+		},
+	})
+	require.NoError(t, err)
+
+	forwarded, ok := rewriter.RewriteUpstream(downstream, ack)
+	require.True(t, ok)
+	assert.JSONEq(t, `{"messageType":"ack","updates":[{"channelID":"1","version":"upstream","code":100}]}`, string(forwarded))
+
+	// Messages pushed while disconnected are delivered on reconnect
+	rewriter.Disconnect(downstream)
+	err = rewriter.Push(&webpush.PushRequest{Token: token, TTL: 60})
+	require.NoError(t, err)
+
+	downstream, conn = newTestDownstream(t)
+	err = rewriter.WriteDownstream(downstream, websocket.TextMessage, []byte(`{"messageType":"hello","uaid":"a","status":200,"use_webpush":true}`))
+	require.NoError(t, err)
+	_, _, err = conn.ReadMessage()
+	require.NoError(t, err)
+
+	notification = readNotification(t, conn)
+	assert.Equal(t, "1", notification.ChannelID)
+
+	// Unregistered endpoints are gone
+	_, ok = rewriter.RewriteUpstream(downstream, []byte(`{"messageType":"unregister","channelID":"1"}`))
+	require.True(t, ok)
+
+	err = rewriter.Push(&webpush.PushRequest{Token: token, TTL: 60})
+	assert.ErrorIs(t, err, webpush.ErrSubscriptionNotFound)
+}
+
+func TestEndpointRewriterPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints.json")
+
+	rewriter, err := OpenEndpointRewriter("https://localhost:8080/push", path)
+	require.NoError(t, err)
+
+	downstream, conn := newTestDownstream(t)
+	err = rewriter.WriteDownstream(downstream, websocket.TextMessage, []byte(`{"messageType":"hello","uaid":"a","status":200,"use_webpush":true}`))
+	require.NoError(t, err)
+	_, _, err = conn.ReadMessage()
+	require.NoError(t, err)
+
+	for _, channelID := range []string{"1", "2"} {
+		err = rewriter.WriteDownstream(downstream, websocket.TextMessage, []byte(`{"messageType":"register","channelID":"`+channelID+`","status":200,"pushEndpoint":"https://updates.push.services.mozilla.com/wpush/v2/`+channelID+`"}`))
+		require.NoError(t, err)
+	}
+
+	var register autoconnect.RegisterMessageResponse
+	require.NoError(t, conn.ReadJSON(&register))
+	token1 := strings.TrimPrefix(register.PushEndpoint, "https://localhost:8080/push/")
+	require.NoError(t, conn.ReadJSON(&register))
+	token2 := strings.TrimPrefix(register.PushEndpoint, "https://localhost:8080/push/")
+
+	_, ok := rewriter.RewriteUpstream(downstream, []byte(`{"messageType":"unregister","channelID":"2"}`))
+	require.True(t, ok)
+
+	// Endpoints rewritten before a restart are kept, unregistered ones are not
+	rewriter, err = OpenEndpointRewriter("https://localhost:8080/push", path)
+	require.NoError(t, err)
+
+	upstream, ok := rewriter.UpstreamEndpoint(token1)
+	require.True(t, ok)
+	assert.Equal(t, "https://updates.push.services.mozilla.com/wpush/v2/1", upstream)
+
+	_, ok = rewriter.UpstreamEndpoint(token2)
+	assert.False(t, ok)
+
+	// The user agent resumes its session, getting messages pushed to the
+	// endpoint
+	downstream, conn = newTestDownstream(t)
+	err = rewriter.WriteDownstream(downstream, websocket.TextMessage, []byte(`{"messageType":"hello","uaid":"a","status":200,"use_webpush":true}`))
+	require.NoError(t, err)
+	_, _, err = conn.ReadMessage()
+	require.NoError(t, err)
+
+	err = rewriter.Push(&webpush.PushRequest{Token: token1, TTL: 60})
+	require.NoError(t, err)
+
+	notification := readNotification(t, conn)
+	assert.Equal(t, "1", notification.ChannelID)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Action is what to do with frames matching a rule.
+type Action string
+
+const (
+	// ActionDrop drops frames.
+	ActionDrop Action = "drop"
+	// ActionDelay delays frames, and all frames after them in the same
+	// direction, keeping the order of frames.
+	ActionDelay Action = "delay"
+	// ActionDuplicate sends frames multiple times.
+	ActionDuplicate Action = "duplicate"
+	// ActionModify sets or removes members of frames.
+	ActionModify Action = "modify"
+)
+
+// Duration is a [time.Duration] encoded as a string in JSON, such as "1.5s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(duration)
+	return nil
+}
+
+// Rule matches frames and applies an action to them. Empty match fields match
+// all frames.
+type Rule struct {
+	Direction   Direction `json:"direction,omitempty"`
+	MessageType string    `json:"messageType,omitempty"`
+	ChannelID   string    `json:"channelID,omitempty"`
+
+	Action Action `json:"action"`
+	// Delay is the time to delay frames by, for [ActionDelay].
+	Delay Duration `json:"delay,omitempty"`
+	// Copies is the number of times to send frames, for [ActionDuplicate].
+	// Defaults to 2.
+	Copies int `json:"copies,omitempty"`
+	// Set holds members to set, for [ActionModify]. Null values remove members.
+	Set map[string]json.RawMessage `json:"set,omitempty"`
+	// Times is the number of frames the rule applies to. Zero means no limit.
+	Times int `json:"times,omitempty"`
+
+	applied int
+}
+
+// Validate returns an error if the rule is invalid.
+func (r *Rule) Validate() error {
+	switch r.Direction {
+	case "", DirectionUpstream, DirectionDownstream:
+	default:
+		return fmt.Errorf("invalid direction: %s", r.Direction)
+	}
+
+	switch r.Action {
+	case ActionDrop:
+	case ActionDelay:
+		if r.Delay <= 0 {
+			return errors.New("delay must be positive")
+		}
+	case ActionDuplicate:
+		if r.Copies < 0 {
+			return errors.New("copies must not be negative")
+		}
+	case ActionModify:
+		if len(r.Set) == 0 {
+			return errors.New("set must not be empty")
+		}
+	default:
+		return fmt.Errorf("invalid action: %s", r.Action)
+	}
+
+	if r.Times < 0 {
+		return errors.New("times must not be negative")
+	}
+
+	return nil
+}
+
+func (r *Rule) matches(direction Direction, messageType string, channelID string) bool {
+	if r.Times > 0 && r.applied >= r.Times {
+		return false
+	}
+
+	return (r.Direction == "" || r.Direction == direction) &&
+		(r.MessageType == "" || r.MessageType == messageType) &&
+		(r.ChannelID == "" || r.ChannelID == channelID)
+}
+
+// Rules holds rules applied to proxied frames. The first matching rule
+// applies.
+type Rules struct {
+	mutex sync.Mutex
+	rules []*Rule
+}
+
+// LoadRules reads rules from a JSON file holding an array of rules.
+func LoadRules(path string) ([]*Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// Set validates and replaces all rules.
+func (r *Rules) Set(rules []*Rule) error {
+	for i, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.rules = rules
+	return nil
+}
+
+// Get returns all rules.
+func (r *Rules) Get() []*Rule {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	rules := make([]*Rule, len(r.rules))
+	for i, rule := range r.rules {
+		c := *rule
+		rules[i] = &c
+	}
+	return rules
+}
+
+// Apply applies the first matching rule to a frame, returning the frames to
+// send in its place and the time to wait before sending them.
+func (r *Rules) Apply(direction Direction, data []byte) ([][]byte, time.Duration) {
+	messageType, channelID := parseFrame(data)
+
+	r.mutex.Lock()
+	var rule *Rule
+	for _, candidate := range r.rules {
+		if candidate.matches(direction, messageType, channelID) {
+			candidate.applied++
+			rule = candidate
+			break
+		}
+	}
+	r.mutex.Unlock()
+
+	if rule == nil {
+		return [][]byte{data}, 0
+	}
+
+	switch rule.Action {
+	case ActionDrop:
+		return nil, 0
+	case ActionDelay:
+		return [][]byte{data}, time.Duration(rule.Delay)
+	case ActionDuplicate:
+		copies := rule.Copies
+		if copies == 0 {
+			copies = 2
+		}
+
+		frames := make([][]byte, copies)
+		for i := range frames {
+			frames[i] = data
+		}
+		return frames, 0
+	case ActionModify:
+		return [][]byte{modifyFrame(data, rule.Set)}, 0
+	}
+
+	return [][]byte{data}, 0
+}
+
+// modifyFrame sets members of a frame, removing those set to null.
+func modifyFrame(data []byte, set map[string]json.RawMessage) []byte {
+	var message map[string]json.RawMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return data
+	}
+
+	for name, value := range set {
+		if string(value) == "null" {
+			delete(message, name)
+		} else {
+			message[name] = value
+		}
+	}
+
+	modifiedData, err := json.Marshal(message)
+	if err != nil {
+		return data
+	}
+
+	return modifiedData
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRulesApply(t *testing.T) {
+	register := `{"messageType":"register","channelID":"1","status":200}`
+	notification := `{"messageType":"notification","channelID":"2","version":"a"}`
+
+	testCases := []struct {
+		Name           string
+		Rules          string
+		Direction      Direction
+		Frame          string
+		ExpectedFrames []string
+		ExpectedDelay  time.Duration
+	}{
+		{
+			Name:           "No rules",
+			Rules:          `[]`,
+			Direction:      DirectionDownstream,
+			Frame:          register,
+			ExpectedFrames: []string{register},
+		},
+		{
+			Name:      "Drop",
+			Rules:     `[{"messageType":"register","action":"drop"}]`,
+			Direction: DirectionDownstream,
+			Frame:     register,
+		},
+		{
+			Name:           "Other direction",
+			Rules:          `[{"direction":"upstream","action":"drop"}]`,
+			Direction:      DirectionDownstream,
+			Frame:          register,
+			ExpectedFrames: []string{register},
+		},
+		{
+			Name:           "Other channel",
+			Rules:          `[{"channelID":"1","action":"drop"}]`,
+			Direction:      DirectionDownstream,
+			Frame:          notification,
+			ExpectedFrames: []string{notification},
+		},
+		{
+			Name:           "Delay",
+			Rules:          `[{"action":"delay","delay":"1.5s"}]`,
+			Direction:      DirectionDownstream,
+			Frame:          notification,
+			ExpectedFrames: []string{notification},
+			ExpectedDelay:  1500 * time.Millisecond,
+		},
+		{
+			Name:           "Duplicate",
+			Rules:          `[{"messageType":"notification","action":"duplicate","copies":3}]`,
+			Direction:      DirectionDownstream,
+			Frame:          notification,
+			ExpectedFrames: []string{notification, notification, notification},
+		},
+		{
+			Name:           "Modify",
+			Rules:          `[{"channelID":"2","action":"modify","set":{"version":"b","channelID":null}}]`,
+			Direction:      DirectionDownstream,
+			Frame:          notification,
+			ExpectedFrames: []string{`{"messageType":"notification","version":"b"}`},
+		},
+		{
+			Name:           "First match",
+			Rules:          `[{"messageType":"ping","action":"drop"},{"action":"duplicate"},{"action":"drop"}]`,
+			Direction:      DirectionUpstream,
+			Frame:          register,
+			ExpectedFrames: []string{register, register},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			var rules []*Rule
+			require.NoError(t, json.Unmarshal([]byte(testCase.Rules), &rules))
+
+			var r Rules
+			require.NoError(t, r.Set(rules))
+
+			frames, delay := r.Apply(testCase.Direction, []byte(testCase.Frame))
+			require.Len(t, frames, len(testCase.ExpectedFrames))
+			for i, frame := range frames {
+				assert.JSONEq(t, testCase.ExpectedFrames[i], string(frame))
+			}
+			assert.Equal(t, testCase.ExpectedDelay, delay)
+		})
+	}
+}
+
+func TestRulesTimes(t *testing.T) {
+	var r Rules
+	require.NoError(t, r.Set([]*Rule{{Action: ActionDrop, Times: 1}}))
+
+	frames, _ := r.Apply(DirectionUpstream, []byte(`{}`))
+	assert.Empty(t, frames)
+
+	frames, _ = r.Apply(DirectionUpstream, []byte(`{}`))
+	assert.Len(t, frames, 1)
+}
+
+func TestRulesSetInvalid(t *testing.T) {
+	var r Rules
+	assert.Error(t, r.Set([]*Rule{{Action: "explode"}}))
+	assert.Error(t, r.Set([]*Rule{{Action: ActionDelay}}))
+	assert.Error(t, r.Set([]*Rule{{Action: ActionModify}}))
+	assert.Error(t, r.Set([]*Rule{{Direction: "sideways", Action: ActionDrop}}))
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Direction is the direction of a proxied frame.
+type Direction string
+
+const (
+	// DirectionUpstream is a frame sent by the user agent to the push service.
+	DirectionUpstream Direction = "upstream"
+	// DirectionDownstream is a frame sent by the push service to the user agent.
+	DirectionDownstream Direction = "downstream"
+)
+
+// Frame is a recorded WebSocket frame.
+type Frame struct {
+	Time         time.Time `json:"time"`
+	ConnectionID string    `json:"connectionId"`
+	Direction    Direction `json:"direction"`
+	// MessageType is the autoconnect message type, if the frame could be parsed.
+	// Pings are recorded as "ping".
+	MessageType string `json:"messageType,omitempty"`
+	Data        string `json:"data"`
+}
+
+// NewFrame creates a frame received now.
+func NewFrame(connectionID string, direction Direction, data []byte) Frame {
+	messageType, _ := parseFrame(data)
+
+	return Frame{
+		Time:         time.Now(),
+		ConnectionID: connectionID,
+		Direction:    direction,
+		MessageType:  messageType,
+		Data:         string(data),
+	}
+}
+
+// parseFrame returns the autoconnect message type and channel ID of a frame,
+// if any.
+func parseFrame(data []byte) (string, string) {
+	var message struct {
+		MessageType string `json:"messageType"`
+		ChannelID   string `json:"channelID"`
+	}
+	if err := json.Unmarshal(data, &message); err != nil {
+		return "", ""
+	}
+
+	// Pings are sent as empty objects
+	if message.MessageType == "" {
+		message.MessageType = "ping"
+	}
+
+	return message.MessageType, message.ChannelID
+}
+
+// Recorder records frames to a JSONL file.
+type Recorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// NewRecorder creates a new [Recorder], appending to the file at path.
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Recorder{
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+// Record writes a frame to the session log.
+func (r *Recorder) Record(frame Frame) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.encoder.Encode(&frame)
+}
+
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.file.Close()
+}
+
+// ReadSession reads a session log, returning the frames of each connection in
+// the order the connections were made.
+func ReadSession(path string) ([][]Frame, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var connections [][]Frame
+	indexes := make(map[string]int)
+
+	scanner := bufio.NewScanner(file)
+	// Frames may be larger than the default limit of 64KiB
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var frame Frame
+		if err := json.Unmarshal(scanner.Bytes(), &frame); err != nil {
+			return nil, err
+		}
+
+		index, ok := indexes[frame.ConnectionID]
+		if !ok {
+			index = len(connections)
+			indexes[frame.ConnectionID] = index
+			connections = append(connections, nil)
+		}
+
+		connections[index] = append(connections[index], frame)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return connections, nil
+}
+
+// Replayer plays back the push service's side of recorded connections.
+type Replayer struct {
+	mutex       sync.Mutex
+	connections [][]Frame
+}
+
+// NewReplayer creates a new [Replayer], playing back each recorded connection
+// once, in order.
+func NewReplayer(connections [][]Frame) *Replayer {
+	return &Replayer{
+		connections: connections,
+	}
+}
+
+func (r *Replayer) next() []Frame {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.connections) == 0 {
+		return nil
+	}
+
+	frames := r.connections[0]
+	r.connections = r.connections[1:]
+	return frames
+}
+
+// Replay plays back the next recorded connection to downstream. Each recorded
+// downstream frame is sent once the user agent has sent the upstream frames
+// preceding it. As user agents pick random channel IDs, channel IDs in
+// downstream frames are rewritten to the ones used by the user agent.
+func (r *Replayer) Replay(downstream *Downstream) error {
+	frames := r.next()
+	if frames == nil {
+		return errors.New("no recorded connections left")
+	}
+
+	// Recorded channel IDs mapped to the ones used by the user agent
+	channelIDs := make(map[string]string)
+
+	for _, frame := range frames {
+		switch frame.Direction {
+		case DirectionUpstream:
+			_, data, err := downstream.conn.ReadMessage()
+			if err != nil {
+				return err
+			}
+			downstream.logFrame(DirectionUpstream, data)
+
+			messageType, channelID := parseFrame(data)
+			if messageType != frame.MessageType {
+				slog.Warn("Got unexpected message", slog.String("expected", frame.MessageType), slog.String("actual", messageType))
+			}
+
+			_, recordedChannelID := parseFrame([]byte(frame.Data))
+			if channelID != "" && recordedChannelID != "" {
+				channelIDs[recordedChannelID] = channelID
+			}
+		case DirectionDownstream:
+			data := rewriteChannelID([]byte(frame.Data), channelIDs)
+			if err := downstream.WriteMessage(websocket.TextMessage, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Keep the connection open until the user agent leaves
+	for {
+		_, data, err := downstream.conn.ReadMessage()
+		if err != nil {
+			return nil
+		}
+		downstream.logFrame(DirectionUpstream, data)
+	}
+}
+
+// rewriteChannelID replaces the channel ID of a frame, if it's mapped.
+func rewriteChannelID(data []byte, channelIDs map[string]string) []byte {
+	var message map[string]json.RawMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return data
+	}
+
+	var channelID string
+	if err := json.Unmarshal(message["channelID"], &channelID); err != nil {
+		return data
+	}
+
+	rewritten, ok := channelIDs[channelID]
+	if !ok {
+		return data
+	}
+
+	message["channelID"], _ = json.Marshal(rewritten)
+	rewrittenData, err := json.Marshal(message)
+	if err != nil {
+		return data
+	}
+
+	return rewrittenData
+}
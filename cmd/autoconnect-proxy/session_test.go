@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+
+	recorder, err := NewRecorder(path)
+	require.NoError(t, err)
+
+	frames := []struct {
+		ConnectionID string
+		Direction    Direction
+		Data         string
+	}{
+		{"a", DirectionUpstream, `{"messageType":"hello","use_webpush":true}`},
+		{"a", DirectionDownstream, `{"messageType":"hello","uaid":"1","status":200,"use_webpush":true}`},
+		{"b", DirectionUpstream, `{"messageType":"hello","uaid":"1","use_webpush":true}`},
+		{"a", DirectionUpstream, `{"messageType":"register","channelID":"recorded"}`},
+		{"a", DirectionUpstream, `{}`},
+		{"a", DirectionDownstream, `{"messageType":"register","channelID":"recorded","status":200}`},
+		{"a", DirectionDownstream, `{}`},
+	}
+	for _, frame := range frames {
+		require.NoError(t, recorder.Record(NewFrame(frame.ConnectionID, frame.Direction, []byte(frame.Data))))
+	}
+	require.NoError(t, recorder.Close())
+
+	connections, err := ReadSession(path)
+	require.NoError(t, err)
+	require.Len(t, connections, 2)
+	require.Len(t, connections[0], 6)
+	assert.Equal(t, "hello", connections[0][0].MessageType)
+	assert.Equal(t, "ping", connections[0][3].MessageType)
+	assert.Equal(t, "b", connections[1][0].ConnectionID)
+
+	replayer := NewReplayer(connections)
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		replayer.Replay(NewDownstream(conn, func(Direction, []byte) {}))
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"messageType":"hello","use_webpush":true}`)))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"messageType":"hello","uaid":"1","status":200,"use_webpush":true}`, string(data))
+
+	// Channel IDs are rewritten to the ones used by the user agent
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"messageType":"register","channelID":"live"}`)))
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{}`)))
+	_, data, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"messageType":"register","channelID":"live","status":200}`, string(data))
+
+	_, data, err = conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, `{}`, string(data))
+}
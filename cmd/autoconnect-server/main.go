@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/autoconnect"
+	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
+)
+
+func main() {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	address := flag.String("address", ":8083", "address to listen on")
+	endpoint := flag.String("endpoint", "http://localhost:8083/push", "base URL of push endpoints")
+	certFile := flag.String("cert", "", "TLS certificate file, serves plain HTTP if empty")
+	keyFile := flag.String("key", "", "TLS key file")
+	flag.Parse()
+
+	server := autoconnect.NewServer(*endpoint)
+	pushServer := webpush.NewPushServer(server)
+
+	// Forget users that have not connected in a long time
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			server.Prune(time.Now())
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle("/push/", pushServer)
+	mux.Handle("/", server)
+
+	var err error
+	if *certFile != "" {
+		err = http.ListenAndServeTLS(*address, *certFile, *keyFile, mux)
+	} else {
+		err = http.ListenAndServe(*address, mux)
+	}
+	if err != nil {
+		slog.Error("Failed to serve", slog.Any("error", err))
+		return
+	}
+}
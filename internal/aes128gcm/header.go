@@ -53,7 +53,7 @@ func (h *Header) UnmarshalBinary(data []byte) error {
 	}
 
 	keyIDLength := int(data[20])
-	if len(data) < 20+keyIDLength {
+	if len(data) < 21+keyIDLength {
 		return fmt.Errorf("invalid key length")
 	}
 
@@ -76,3 +76,12 @@ func TestHeader(t *testing.T) {
 		})
 	}
 }
+
+func TestHeaderTruncatedKeyID(t *testing.T) {
+	// Header declaring a 3B key id, but only holding 2B
+	data, err := base64.RawURLEncoding.DecodeString("uNCkWiNYzKTnBN9ji3-qWAAAABkDYTE")
+	require.NoError(t, err)
+
+	var header Header
+	assert.Error(t, header.UnmarshalBinary(data))
+}
@@ -1,58 +1,413 @@
 package autoconnect
 
 import (
+	"context"
 	"crypto/ecdh"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"log/slog"
+	"sync"
+	"time"
 
 	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
 	"github.com/google/uuid"
 )
 
 var _ webpush.Subscriber = (*Client)(nil)
+var _ webpush.MessageSubscriber = (*Client)(nil)
+var _ webpush.ChangingSubscriber = (*Client)(nil)
+
+// Reconnection backoff.
+const (
+	minReconnectBackoff = 1 * time.Second
+	maxReconnectBackoff = 1 * time.Minute
+)
+
+// requestTimeout is the time to wait for a response to requests made without
+// a context.
+const requestTimeout = 30 * time.Second
 
 // Client implements a autoconnect client for interacting with Mozilla's
 // Web Push service.
+// The client reconnects if the connection is lost, resuming the session
+// using the UAID assigned by the service. If the service assigns a new UAID,
+// all channels are registered anew.
 type Client struct {
-	conn *Conn
-	uaid string
+	url    string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex sync.Mutex
+	conn  *Conn
+	uaid  string
+	// channels maps channel IDs to the user agent public key they were
+	// registered with.
+	channels map[string]string
+	// broadcasts maps subscribed broadcast IDs to their last known version.
+	broadcasts map[string]string
+
+	onMessage        func(Message)
+	onBroadcast      func(map[string]string)
+	onPushMessage    func(webpush.ReceivedMessage) error
+	onEndpointChange func(string, string)
 }
 
-func NewClient(url string) (*Client, error) {
-	conn, err := Dial(url)
+// NewClient creates a new client for the service at url.
+// To resume a previous session, specify the UAID and channels assigned in
+// that session. Channels map channel IDs to the user agent public key they
+// were registered with, letting them be registered anew should the service
+// assign a new UAID.
+// Set any handlers before connecting using [Client.Connect], as pending
+// notifications are delivered as soon as the client connects.
+func NewClient(url string, uaid string, channels map[string]string) *Client {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := &Client{
+		url:    url,
+		ctx:    ctx,
+		cancel: cancel,
+
+		uaid:       uaid,
+		channels:   make(map[string]string, len(channels)),
+		broadcasts: make(map[string]string),
+	}
+
+	for channelID, key := range channels {
+		c.channels[channelID] = key
+	}
+
+	return c
+}
+
+// Connect connects to the service. Once connected, the client reconnects each
+// time the connection is lost, until the client is closed.
+func (c *Client) Connect() error {
+	if err := c.connect(); err != nil {
+		return err
+	}
+
+	go c.reconnect()
+
+	return nil
+}
+
+// connect connects to the service, resuming the session if there is one.
+func (c *Client) connect() error {
+	conn, err := Dial(c.url)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	// Notifications may arrive before the connection is in use, make sure to
+	// ack them on the connection they arrived on
+	conn.OnMessage(func(message Message) {
+		c.handleMessage(conn, message)
+	})
 
-	c := &Client{
-		conn: conn,
+	c.mutex.Lock()
+	uaid := c.uaid
+	channelIDs := make([]string, 0, len(c.channels))
+	for channelID := range c.channels {
+		channelIDs = append(channelIDs, channelID)
 	}
+	broadcasts := make(map[string]string, len(c.broadcasts))
+	for id, version := range c.broadcasts {
+		broadcasts[id] = version
+	}
+	c.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(c.ctx, requestTimeout)
+	defer cancel()
 
-	response, err := conn.Send(&HelloMessageRequest{
+	response, err := conn.Send(ctx, &HelloMessageRequest{
 		MessageType: "hello",
+		UAID:        uaid,
+		ChannelIDs:  channelIDs,
 		UseWebPush:  true,
-		Broadcasts:  make(map[string]any),
+		Broadcasts:  broadcasts,
 	})
 	if err != nil {
 		conn.Close()
-		return nil, err
+		return err
 	}
 
 	helloResponse := response.(*HelloMessageResponse)
 	if helloResponse.Status != 200 {
-		return nil, fmt.Errorf("got unexpected status: %d", helloResponse.Status)
+		conn.Close()
+		return fmt.Errorf("got unexpected status: %d", helloResponse.Status)
+	}
+
+	c.mutex.Lock()
+	c.conn = conn
+	c.uaid = helloResponse.UAID
+	c.mutex.Unlock()
+
+	if len(helloResponse.Broadcasts) > 0 {
+		c.updateBroadcasts(helloResponse.Broadcasts)
+	}
+
+	if uaid != "" && uaid != helloResponse.UAID {
+		slog.Info("Got new UAID, registering channels", slog.String("uaid", helloResponse.UAID))
+		c.reregister()
+	}
+
+	return nil
+}
+
+// SubscribeBroadcasts subscribes to broadcasts, mapping broadcast IDs to the
+// last known version. Use an empty version if the version is not known.
+// Broadcasts whose version differ are reported to the handler set using
+// [Client.OnBroadcast].
+func (c *Client) SubscribeBroadcasts(broadcasts map[string]string) error {
+	c.mutex.Lock()
+	for id, version := range broadcasts {
+		c.broadcasts[id] = version
+	}
+	c.mutex.Unlock()
+
+	conn, err := c.getConn()
+	if err != nil {
+		return err
+	}
+
+	return conn.Write(&BroadcastSubscribeMessageRequest{
+		MessageType: "broadcast_subscribe",
+		Broadcasts:  broadcasts,
+	})
+}
+
+// OnBroadcast sets a handler to be invoked with the new versions each time
+// subscribed broadcasts change.
+func (c *Client) OnBroadcast(handler func(broadcasts map[string]string)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.onBroadcast = handler
+}
+
+// updateBroadcasts keeps track of changed broadcasts and reports them.
+func (c *Client) updateBroadcasts(broadcasts map[string]string) {
+	c.mutex.Lock()
+	for id, version := range broadcasts {
+		c.broadcasts[id] = version
+	}
+	handler := c.onBroadcast
+	c.mutex.Unlock()
+
+	if handler != nil {
+		handler(broadcasts)
+	}
+}
+
+// reregister registers all known channels anew, such as after the service
+// assigned a new UAID.
+func (c *Client) reregister() {
+	c.mutex.Lock()
+	channels := make(map[string]string, len(c.channels))
+	for channelID, key := range c.channels {
+		channels[channelID] = key
+	}
+	handler := c.onEndpointChange
+	c.mutex.Unlock()
+
+	for channelID, key := range channels {
+		ctx, cancel := context.WithTimeout(c.ctx, requestTimeout)
+		endpoint, err := c.Register(ctx, channelID, key)
+		cancel()
+		if err != nil {
+			slog.Error("Failed to register channel", slog.String("channelId", channelID), slog.Any("error", err))
+			continue
+		}
+
+		if handler != nil {
+			handler(channelID, endpoint)
+		}
+	}
+}
+
+// reconnect reconnects each time the connection is lost, using exponential
+// backoff, until the client is closed.
+func (c *Client) reconnect() {
+	for {
+		c.mutex.Lock()
+		conn := c.conn
+		c.mutex.Unlock()
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-conn.Done():
+		}
+
+		backoff := minReconnectBackoff
+		for {
+			slog.Warn("Connection lost, reconnecting", slog.Duration("backoff", backoff))
+
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			err := c.connect()
+			if err == nil {
+				slog.Info("Reconnected")
+				break
+			}
+
+			slog.Error("Failed to reconnect", slog.Any("error", err))
+			backoff = min(2*backoff, maxReconnectBackoff)
+		}
+	}
+}
+
+// UAID returns the user agent ID assigned by the service.
+func (c *Client) UAID() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.uaid
+}
+
+// getConn returns the current connection.
+// Returns [ErrClosed] if the client has not connected.
+func (c *Client) getConn() (*Conn, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == nil {
+		return nil, ErrClosed
 	}
 
-	return c, nil
+	return c.conn, nil
 }
 
+// OnMessage sets a handler to be invoked on each received message.
 func (c *Client) OnMessage(handler func(Message)) {
-	c.conn.OnMessage(handler)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.onMessage = handler
+}
+
+// OnEndpointChange implements webpush.ChangingSubscriber.
+func (c *Client) OnEndpointChange(handler func(subscriptionID string, endpoint string)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.onEndpointChange = handler
+}
+
+// OnPushMessage implements webpush.MessageSubscriber.
+func (c *Client) OnPushMessage(handler func(webpush.ReceivedMessage) error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.onPushMessage = handler
+}
+
+func (c *Client) handleMessage(conn *Conn, message Message) {
+	c.mutex.Lock()
+	onMessage := c.onMessage
+	onPushMessage := c.onPushMessage
+	c.mutex.Unlock()
+
+	if onMessage != nil {
+		onMessage(message)
+	}
+
+	if broadcast, ok := message.(*BroadcastMessage); ok {
+		c.updateBroadcasts(broadcast.Broadcasts)
+		return
+	}
+
+	notification, ok := message.(*NotificationMessage)
+	if !ok || onPushMessage == nil {
+		return
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(notification.Data)
+	if err != nil {
+		slog.Warn("Got invalid message body", slog.Any("error", err))
+		// Redelivering the message won't help
+		c.acknowledge(conn, notification, AckCodeDecryptionFailed)
+		return
+	}
+
+	err = onPushMessage(webpush.ReceivedMessage{
+		SubscriptionID: notification.ChannelID,
+		ContentType:    notification.Headers["content_type"],
+		Content:        data,
+	})
+	switch {
+	case err == nil:
+		c.acknowledge(conn, notification, AckCodeDelivered)
+	case errors.Is(err, webpush.ErrDecryptionFailed):
+		slog.Warn("Failed to decrypt message", slog.Any("error", err))
+		c.acknowledge(conn, notification, AckCodeDecryptionFailed)
+	case errors.Is(err, webpush.ErrSubscriptionNotFound):
+		slog.Warn("Got message for unknown subscription", slog.String("channelId", notification.ChannelID))
+		c.acknowledge(conn, notification, AckCodeNotDelivered)
+	default:
+		slog.Warn("Failed to handle message", slog.Any("error", err))
+		// Leave the message for the service to redeliver
+		err := conn.Write(&NackMessageRequest{
+			MessageType: "nack",
+			Version:     notification.Version,
+			Code:        NackCodeError,
+		})
+		if err != nil {
+			slog.Warn("Failed to nack message", slog.Any("error", err))
+		}
+	}
+}
+
+// acknowledge acks a notification on the connection it was received on,
+// letting the service drop it.
+func (c *Client) acknowledge(conn *Conn, notification *NotificationMessage, code int) {
+	err := conn.Write(&AckMessageRequest{
+		MessageType: "ack",
+		Updates: []AckUpdate{{
+			ChannelID: notification.ChannelID,
+			Version:   notification.Version,
+			Code:      code,
+		}},
+	})
+	if err != nil {
+		slog.Warn("Failed to ack message", slog.Any("error", err))
+	}
+}
+
+// Ack acknowledges received notifications, letting the service drop them.
+func (c *Client) Ack(updates ...AckUpdate) error {
+	conn, err := c.getConn()
+	if err != nil {
+		return err
+	}
+
+	return conn.Write(&AckMessageRequest{
+		MessageType: "ack",
+		Updates:     updates,
+	})
+}
+
+// Nack reports that a notification could not be handled.
+func (c *Client) Nack(version string, code int) error {
+	conn, err := c.getConn()
+	if err != nil {
+		return err
+	}
+
+	return conn.Write(&NackMessageRequest{
+		MessageType: "nack",
+		Version:     version,
+		Code:        code,
+	})
 }
 
 // Register registers a subscription.
-func (c *Client) Register(channelID string, key string) (string, error) {
-	response, err := c.conn.Send(&RegisterMessageRequest{
+func (c *Client) Register(ctx context.Context, channelID string, key string) (string, error) {
+	conn, err := c.getConn()
+	if err != nil {
+		return "", err
+	}
+
+	response, err := conn.Send(ctx, &RegisterMessageRequest{
 		MessageType: "register",
 		ChannelID:   channelID,
 		Key:         key,
@@ -66,23 +421,53 @@ func (c *Client) Register(channelID string, key string) (string, error) {
 		return "", fmt.Errorf("got unexpected status: %d", registerResponse.Status)
 	}
 
-	if registerResponse.Status != 200 {
-		return "", fmt.Errorf("got unexpected status: %d", registerResponse.Status)
-	}
+	c.mutex.Lock()
+	c.channels[channelID] = key
+	c.mutex.Unlock()
 
 	return registerResponse.PushEndpoint, nil
 }
 
+// Unregister removes a subscription.
+func (c *Client) Unregister(ctx context.Context, channelID string) error {
+	conn, err := c.getConn()
+	if err != nil {
+		return err
+	}
+
+	response, err := conn.Send(ctx, &UnregisterMessageRequest{
+		MessageType: "unregister",
+		ChannelID:   channelID,
+	})
+	if err != nil {
+		return err
+	}
+
+	unregisterResponse := response.(*UnregisterMessageResponse)
+	if unregisterResponse.Status != 200 {
+		return fmt.Errorf("got unexpected status: %d", unregisterResponse.Status)
+	}
+
+	c.mutex.Lock()
+	delete(c.channels, channelID)
+	c.mutex.Unlock()
+
+	return nil
+}
+
 // Subscribe implements webpush.PushService.
 func (c *Client) Subscribe(userAgentPrivateKey *ecdh.PrivateKey, _ *ecdh.PublicKey) (string, string, error) {
 	uuid, err := uuid.NewRandom()
 	if err != nil {
-		return "", "", nil
+		return "", "", err
 	}
 
 	channelID := uuid.String()
 
-	endpoint, err := c.Register(channelID, base64.RawURLEncoding.EncodeToString(userAgentPrivateKey.PublicKey().Bytes()))
+	ctx, cancel := context.WithTimeout(c.ctx, requestTimeout)
+	defer cancel()
+
+	endpoint, err := c.Register(ctx, channelID, base64.RawURLEncoding.EncodeToString(userAgentPrivateKey.PublicKey().Bytes()))
 	if err != nil {
 		return "", "", err
 	}
@@ -90,6 +475,21 @@ func (c *Client) Subscribe(userAgentPrivateKey *ecdh.PrivateKey, _ *ecdh.PublicK
 	return channelID, endpoint, nil
 }
 
+// Unsubscribe implements webpush.Subscriber.
+func (c *Client) Unsubscribe(subscriptionID string) error {
+	ctx, cancel := context.WithTimeout(c.ctx, requestTimeout)
+	defer cancel()
+
+	return c.Unregister(ctx, subscriptionID)
+}
+
 func (c *Client) Close() error {
-	return c.conn.Close()
+	c.cancel()
+
+	conn, err := c.getConn()
+	if err != nil {
+		return nil
+	}
+
+	return conn.Close()
 }
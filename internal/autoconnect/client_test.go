@@ -0,0 +1,240 @@
+package autoconnect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConn is a client's connection to a fake service.
+type fakeConn struct {
+	*websocket.Conn
+	// Hello is the hello sent by the client.
+	Hello HelloMessageRequest
+}
+
+// newFakeService serves a minimal autoconnect service that greets clients and
+// hands over their connections, letting tests act as the service.
+// The given broadcasts are included in the hello response.
+func newFakeService(t *testing.T, broadcasts map[string]string) (string, <-chan *fakeConn) {
+	conns := make(chan *fakeConn, 1)
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		c := &fakeConn{Conn: conn}
+		if err := conn.ReadJSON(&c.Hello); err != nil {
+			conn.Close()
+			return
+		}
+
+		err = conn.WriteJSON(&HelloMessageResponse{
+			MessageType: "hello",
+			UAID:        "uaid",
+			Status:      200,
+			UseWebPush:  true,
+			Broadcasts:  broadcasts,
+		})
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		conns <- c
+	}))
+	t.Cleanup(server.Close)
+
+	return "ws" + strings.TrimPrefix(server.URL, "http"), conns
+}
+
+func TestClientAcknowledge(t *testing.T) {
+	testCases := []struct {
+		Name string
+		Data string
+		Err  error
+		// Expected is the expected ack or nack
+		Expected any
+	}{
+		{
+			Name:     "Delivered",
+			Data:     "SGVsbG8sIFdvcmxkIQ",
+			Expected: &AckMessageRequest{MessageType: "ack", Updates: []AckUpdate{{ChannelID: "channel", Version: "1", Code: AckCodeDelivered}}},
+		},
+		{
+			Name:     "Invalid body",
+			Data:     "!",
+			Expected: &AckMessageRequest{MessageType: "ack", Updates: []AckUpdate{{ChannelID: "channel", Version: "1", Code: AckCodeDecryptionFailed}}},
+		},
+		{
+			Name:     "Decryption failed",
+			Data:     "SGVsbG8sIFdvcmxkIQ",
+			Err:      fmt.Errorf("%w: invalid padding", webpush.ErrDecryptionFailed),
+			Expected: &AckMessageRequest{MessageType: "ack", Updates: []AckUpdate{{ChannelID: "channel", Version: "1", Code: AckCodeDecryptionFailed}}},
+		},
+		{
+			Name:     "Unknown subscription",
+			Data:     "SGVsbG8sIFdvcmxkIQ",
+			Err:      webpush.ErrSubscriptionNotFound,
+			Expected: &AckMessageRequest{MessageType: "ack", Updates: []AckUpdate{{ChannelID: "channel", Version: "1", Code: AckCodeNotDelivered}}},
+		},
+		{
+			Name:     "No listeners",
+			Data:     "SGVsbG8sIFdvcmxkIQ",
+			Err:      webpush.ErrNoListeners,
+			Expected: &NackMessageRequest{MessageType: "nack", Version: "1", Code: NackCodeError},
+		},
+		{
+			Name:     "Other error",
+			Data:     "SGVsbG8sIFdvcmxkIQ",
+			Err:      errors.New("failed"),
+			Expected: &NackMessageRequest{MessageType: "nack", Version: "1", Code: NackCodeError},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			url, conns := newFakeService(t, nil)
+
+			client := NewClient(url, "", nil)
+			client.OnPushMessage(func(message webpush.ReceivedMessage) error {
+				return testCase.Err
+			})
+			require.NoError(t, client.Connect())
+			t.Cleanup(func() { client.Close() })
+
+			conn := <-conns
+			t.Cleanup(func() { conn.Close() })
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			err := conn.WriteJSON(&NotificationMessage{
+				MessageType: "notification",
+				ChannelID:   "channel",
+				Version:     "1",
+				Data:        testCase.Data,
+				Headers:     map[string]string{"encoding": "aes128gcm"},
+			})
+			require.NoError(t, err)
+
+			// Decode into the same type as expected
+			var actual any
+			switch testCase.Expected.(type) {
+			case *AckMessageRequest:
+				actual = &AckMessageRequest{}
+			case *NackMessageRequest:
+				actual = &NackMessageRequest{}
+			}
+			require.NoError(t, conn.ReadJSON(actual))
+			assert.Equal(t, testCase.Expected, actual)
+		})
+	}
+}
+
+func TestClientBroadcasts(t *testing.T) {
+	url, conns := newFakeService(t, map[string]string{"a": "v2"})
+
+	broadcasts := make(chan map[string]string, 2)
+	client := NewClient(url, "", nil)
+	client.OnBroadcast(func(b map[string]string) {
+		broadcasts <- b
+	})
+
+	// Changes are reported as part of the hello response
+	require.NoError(t, client.Connect())
+	t.Cleanup(func() { client.Close() })
+	assert.Equal(t, map[string]string{"a": "v2"}, <-broadcasts)
+
+	conn := <-conns
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	require.NoError(t, client.SubscribeBroadcasts(map[string]string{"b": "v1"}))
+
+	var subscribe BroadcastSubscribeMessageRequest
+	require.NoError(t, conn.ReadJSON(&subscribe))
+	assert.Equal(t, &BroadcastSubscribeMessageRequest{
+		MessageType: "broadcast_subscribe",
+		Broadcasts:  map[string]string{"b": "v1"},
+	}, &subscribe)
+
+	// Changes are reported as they're broadcast
+	err := conn.WriteJSON(&BroadcastMessage{
+		MessageType: "broadcast",
+		Broadcasts:  map[string]string{"b": "v2"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"b": "v2"}, <-broadcasts)
+
+	// The last known versions are sent when reconnecting
+	conn.Close()
+	conn = <-conns
+	defer conn.Close()
+	assert.Equal(t, map[string]string{"a": "v2", "b": "v2"}, conn.Hello.Broadcasts)
+}
+
+func TestClientNotConnected(t *testing.T) {
+	client := NewClient("ws://localhost:0", "", nil)
+
+	testCases := []struct {
+		Name          string
+		Call          func() error
+		ExpectedError error
+	}{
+		{
+			Name: "Register",
+			Call: func() error {
+				_, err := client.Register(context.TODO(), "channel", "")
+				return err
+			},
+			ExpectedError: ErrClosed,
+		},
+		{
+			Name:          "Unregister",
+			Call:          func() error { return client.Unregister(context.TODO(), "channel") },
+			ExpectedError: ErrClosed,
+		},
+		{
+			Name:          "Subscribe broadcasts",
+			Call:          func() error { return client.SubscribeBroadcasts(map[string]string{"a": "v1"}) },
+			ExpectedError: ErrClosed,
+		},
+		{
+			Name:          "Ack",
+			Call:          func() error { return client.Ack(AckUpdate{ChannelID: "channel", Version: "1"}) },
+			ExpectedError: ErrClosed,
+		},
+		{
+			Name:          "Nack",
+			Call:          func() error { return client.Nack("1", NackCodeError) },
+			ExpectedError: ErrClosed,
+		},
+		{
+			Name: "Close",
+			Call: client.Close,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			// Fails instead of panicking before connecting
+			err := testCase.Call()
+			if testCase.ExpectedError == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, testCase.ExpectedError)
+			}
+		})
+	}
+}
@@ -1,22 +1,57 @@
 package autoconnect
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// Keepalive.
+const (
+	// pingInterval is how often an autoconnect ping is sent, mirroring Firefox's
+	// dom.push.pingInterval.
+	pingInterval = 30 * time.Minute
+	// webSocketPingInterval is how often a WebSocket ping is sent.
+	webSocketPingInterval = 30 * time.Second
+	// readTimeout is how long to wait for any message, including WebSocket
+	// pongs, before the connection is considered dead.
+	readTimeout = 2 * webSocketPingInterval
+)
+
 type Message interface {
 	Type() string
 }
 
+// PingMessage is autoconnect's application-level ping, an empty JSON object.
+// The service responds with the same message.
+type PingMessage struct{}
+
+func (r *PingMessage) Type() string {
+	return "ping"
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r *PingMessage) MarshalJSON() ([]byte, error) {
+	return []byte("{}"), nil
+}
+
 type HelloMessageRequest struct {
-	MessageType string         `json:"messageType"`
-	UseWebPush  bool           `json:"use_webpush"`
-	Broadcasts  map[string]any `json:"broadcasts"`
+	MessageType string `json:"messageType"`
+	// UAID is the previously assigned user agent ID, if any.
+	UAID string `json:"uaid,omitempty"`
+	// ChannelIDs are the channels registered for the UAID, letting the service
+	// verify that it has the same view of the registered channels.
+	ChannelIDs []string `json:"channelIDs,omitempty"`
+	UseWebPush bool     `json:"use_webpush"`
+	// Broadcasts maps broadcast IDs to subscribe to to the last known
+	// version.
+	Broadcasts map[string]string `json:"broadcasts"`
 }
 
 func (r *HelloMessageRequest) Type() string {
@@ -24,11 +59,13 @@ func (r *HelloMessageRequest) Type() string {
 }
 
 type HelloMessageResponse struct {
-	MessageType string         `json:"messageType"`
-	UAID        string         `json:"uaid"`
-	Status      int            `json:"status"`
-	UseWebPush  bool           `json:"use_webpush"`
-	Broadcasts  map[string]any `json:"broadcasts"`
+	MessageType string `json:"messageType"`
+	UAID        string `json:"uaid"`
+	Status      int    `json:"status"`
+	UseWebPush  bool   `json:"use_webpush"`
+	// Broadcasts maps subscribed broadcast IDs to their current version, for
+	// broadcasts whose version differ from the one sent in the hello.
+	Broadcasts map[string]string `json:"broadcasts"`
 }
 
 func (r *HelloMessageResponse) Type() string {
@@ -56,12 +93,114 @@ func (r *RegisterMessageResponse) Type() string {
 	return "register"
 }
 
-type NotificationMessage struct {
+type UnregisterMessageRequest struct {
+	MessageType string `json:"messageType"`
+	ChannelID   string `json:"channelID"`
+	// Code is an optional reason for unregistering.
+	Code int `json:"code,omitempty"`
+}
+
+func (r *UnregisterMessageRequest) Type() string {
+	return "unregister"
+}
+
+type UnregisterMessageResponse struct {
+	MessageType string `json:"messageType"`
+	ChannelID   string `json:"channelID"`
+	Status      int    `json:"status"`
+}
+
+func (r *UnregisterMessageResponse) Type() string {
+	return "unregister"
+}
+
+// Ack codes describe how a notification was handled.
+const (
+	// AckCodeDelivered indicates that the message was delivered to the
+	// application.
+	AckCodeDelivered = 100
+	// AckCodeDecryptionFailed indicates that the message was received, but
+	// could not be decrypted.
+	AckCodeDecryptionFailed = 101
+	// AckCodeNotDelivered indicates that the message was received, but not
+	// delivered to the application.
+	AckCodeNotDelivered = 102
+)
+
+// AckMessageRequest acknowledges received notifications, letting the service
+// drop them. Unacknowledged notifications are redelivered.
+type AckMessageRequest struct {
+	MessageType string      `json:"messageType"`
+	Updates     []AckUpdate `json:"updates"`
+}
+
+func (r *AckMessageRequest) Type() string {
+	return "ack"
+}
+
+// AckUpdate identifies an acknowledged notification.
+type AckUpdate struct {
+	ChannelID string `json:"channelID"`
+	Version   string `json:"version"`
+	Code      int    `json:"code,omitempty"`
+}
+
+// Nack codes describe why a notification could not be handled.
+const (
+	// NackCodeException indicates that the application failed with an
+	// exception while handling the message.
+	NackCodeException = 301
+	// NackCodeRejected indicates that the application rejected the message.
+	NackCodeRejected = 302
+	// NackCodeError indicates that the message could not be handled for some
+	// other reason.
+	NackCodeError = 303
+)
+
+// NackMessageRequest reports that a notification could not be handled.
+type NackMessageRequest struct {
+	MessageType string `json:"messageType"`
+	Version     string `json:"version"`
+	Code        int    `json:"code,omitempty"`
+}
+
+func (r *NackMessageRequest) Type() string {
+	return "nack"
+}
+
+// BroadcastSubscribeMessageRequest subscribes to broadcasts, mapping
+// broadcast IDs to the last known version. The service responds with a
+// [BroadcastMessage] for broadcasts whose version differ.
+type BroadcastSubscribeMessageRequest struct {
 	MessageType string            `json:"messageType"`
-	ChannelID   string            `json:"channelID"`
-	Version     string            `json:"version"`
-	Data        string            `json:"data"`
-	Headers     map[string]string `json:"headers"`
+	Broadcasts  map[string]string `json:"broadcasts"`
+}
+
+func (r *BroadcastSubscribeMessageRequest) Type() string {
+	return "broadcast_subscribe"
+}
+
+// BroadcastMessage is sent by the service when the version of subscribed
+// broadcasts change, such as Remote Settings collections.
+type BroadcastMessage struct {
+	MessageType string `json:"messageType"`
+	// Broadcasts maps broadcast IDs to their new version.
+	Broadcasts map[string]string `json:"broadcasts"`
+}
+
+func (r *BroadcastMessage) Type() string {
+	return "broadcast"
+}
+
+type NotificationMessage struct {
+	MessageType string `json:"messageType"`
+	ChannelID   string `json:"channelID"`
+	Version     string `json:"version"`
+	Data        string `json:"data"`
+	// Headers holds the HTTP headers of the push message relevant to the user
+	// agent, keyed by their lowercase name using underscores, such as
+	// "encoding" and "content_type".
+	Headers map[string]string `json:"headers"`
 }
 
 func (r *NotificationMessage) Type() string {
@@ -70,10 +209,42 @@ func (r *NotificationMessage) Type() string {
 
 // Conn provides "low-level" means of interacting with Mozilla's autoconnect
 // service.
+// Responses are correlated with their requests using the message type and,
+// where applicable, the channel ID. Messages not correlated with a pending
+// request are passed to the handler set using [Conn.OnMessage].
 type Conn struct {
+	conn *websocket.Conn
+	done chan struct{}
+
+	// writeMutex serializes writes.
+	writeMutex sync.Mutex
+
 	mutex     sync.Mutex
-	conn      *websocket.Conn
 	onMessage func(Message)
+	pending   map[string]chan Message
+}
+
+// ErrClosed is returned when a request cannot be completed as the connection
+// was lost or closed, or a client has not connected.
+var ErrClosed = errors.New("connection closed")
+
+// correlationKey returns the key used to correlate a request with its
+// response, or false if the message is not a request or response.
+func correlationKey(message Message) (string, bool) {
+	switch m := message.(type) {
+	case *HelloMessageRequest, *HelloMessageResponse:
+		return "hello", true
+	case *RegisterMessageRequest:
+		return "register/" + m.ChannelID, true
+	case *RegisterMessageResponse:
+		return "register/" + m.ChannelID, true
+	case *UnregisterMessageRequest:
+		return "unregister/" + m.ChannelID, true
+	case *UnregisterMessageResponse:
+		return "unregister/" + m.ChannelID, true
+	default:
+		return "", false
+	}
 }
 
 // Dial connects to a autoconnect server.
@@ -88,13 +259,47 @@ func Dial(url string) (*Conn, error) {
 	}
 
 	c := &Conn{
-		conn: conn,
+		conn:    conn,
+		done:    make(chan struct{}),
+		pending: make(map[string]chan Message),
 	}
 
-	// TODO: Pinging?
+	// Consider the connection dead unless any message or pong is received in
+	// time
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(readTimeout))
+	})
+
+	// Ping pump
+	go func() {
+		webSocketPingTicker := time.NewTicker(webSocketPingInterval)
+		defer webSocketPingTicker.Stop()
+
+		pingTicker := time.NewTicker(pingInterval)
+		defer pingTicker.Stop()
+
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-webSocketPingTicker.C:
+				// NOTE: WriteControl is safe to use concurrently with other writes
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(webSocketPingInterval))
+				if err != nil {
+					slog.Warn("Failed to send WebSocket ping", slog.Any("error", err))
+				}
+			case <-pingTicker.C:
+				if err := c.Write(&PingMessage{}); err != nil {
+					slog.Warn("Failed to send ping", slog.Any("error", err))
+				}
+			}
+		}
+	}()
 
 	// Read pump
 	go func() {
+		defer close(c.done)
 		defer conn.Close()
 
 		for {
@@ -105,6 +310,7 @@ func Dial(url string) (*Conn, error) {
 				return
 			}
 			slog.Debug("Read message", slog.String("message", string(data)))
+			conn.SetReadDeadline(time.Now().Add(readTimeout))
 
 			var envelope struct {
 				MessageType string `json:"messageType"`
@@ -116,12 +322,19 @@ func Dial(url string) (*Conn, error) {
 
 			var message Message
 			switch envelope.MessageType {
+			case "", "ping":
+				// Ping response
+				continue
+			case "broadcast":
+				message = &BroadcastMessage{}
 			case "hello":
 				message = &HelloMessageResponse{}
 			case "notification":
 				message = &NotificationMessage{}
 			case "register":
 				message = &RegisterMessageResponse{}
+			case "unregister":
+				message = &UnregisterMessageResponse{}
 			default:
 				slog.Warn("Got unknown message", slog.String("messageType", envelope.MessageType))
 				continue
@@ -131,19 +344,41 @@ func Dial(url string) (*Conn, error) {
 				continue
 			}
 
-			handler := c.onMessage
-			if handler == nil {
-				slog.Warn("Dropped message", slog.Any("message", message))
-			} else {
-				handler(message)
-			}
+			c.dispatch(message)
 		}
 	}()
 
 	return c, nil
 }
 
-// OnMessage sets a handler to be invoked on each received message.
+// dispatch passes a message to the pending request it responds to, or to the
+// handler.
+func (c *Conn) dispatch(message Message) {
+	c.mutex.Lock()
+	var response chan Message
+	if key, ok := correlationKey(message); ok {
+		response = c.pending[key]
+		delete(c.pending, key)
+	}
+	handler := c.onMessage
+	c.mutex.Unlock()
+
+	if response != nil {
+		// Buffered, never blocks
+		response <- message
+		return
+	}
+
+	if handler == nil {
+		slog.Warn("Dropped message", slog.Any("message", message))
+		return
+	}
+
+	handler(message)
+}
+
+// OnMessage sets a handler to be invoked on each received message that is not
+// a response to a request made using [Conn.Send].
 func (c *Conn) OnMessage(handler func(Message)) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -151,40 +386,55 @@ func (c *Conn) OnMessage(handler func(Message)) {
 }
 
 func (c *Conn) Write(message Message) error {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
 	return c.conn.WriteJSON(message)
 }
 
-func (c *Conn) Send(message Message) (Message, error) {
+// Send sends a request and waits for its response.
+// Returns [ErrClosed] if the connection is lost before a response is
+// received.
+func (c *Conn) Send(ctx context.Context, message Message) (Message, error) {
+	key, ok := correlationKey(message)
+	if !ok {
+		return nil, fmt.Errorf("message type %s has no response", message.Type())
+	}
+
+	response := make(chan Message, 1)
+
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	if _, ok := c.pending[key]; ok {
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("a %s request is already pending", message.Type())
+	}
+	c.pending[key] = response
+	c.mutex.Unlock()
 
-	handler := c.onMessage
 	defer func() {
-		c.onMessage = handler
+		c.mutex.Lock()
+		if c.pending[key] == response {
+			delete(c.pending, key)
+		}
+		c.mutex.Unlock()
 	}()
 
-	messages := make(chan Message)
-	defer close(messages)
-	c.onMessage = func(m Message) {
-		messages <- m
-	}
-
-	if err := c.conn.WriteJSON(message); err != nil {
+	if err := c.Write(message); err != nil {
 		return nil, err
 	}
 
-	response, ok := <-messages
-	if !ok {
-		return nil, fmt.Errorf("no response received")
-	}
-
-	if response.Type() != message.Type() {
-		return nil, fmt.Errorf("got unexpected message type: %s", response.Type())
+	select {
+	case m := <-response:
+		return m, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ErrClosed
 	}
+}
 
-	return response, nil
+// Done returns a channel that's closed when the connection is lost or closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
 }
 
 func (c *Conn) Close() error {
@@ -0,0 +1,127 @@
+package autoconnect
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnSend(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// Respond to both registrations in the reverse order of their arrival,
+		// with a notification in between. As the responses echo the channel IDs,
+		// the order in which the requests are sent doesn't matter
+		var requests [2]RegisterMessageRequest
+		for i := range requests {
+			if err := conn.ReadJSON(&requests[i]); err != nil {
+				return
+			}
+		}
+
+		conn.WriteJSON(&NotificationMessage{MessageType: "notification", ChannelID: requests[0].ChannelID, Version: "1"})
+		for i := len(requests) - 1; i >= 0; i-- {
+			conn.WriteJSON(&RegisterMessageResponse{
+				MessageType:  "register",
+				ChannelID:    requests[i].ChannelID,
+				Status:       200,
+				PushEndpoint: "https://example.com/" + requests[i].ChannelID,
+			})
+		}
+
+		conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	conn, err := Dial("ws" + strings.TrimPrefix(server.URL, "http"))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	notifications := make(chan Message, 1)
+	conn.OnMessage(func(message Message) {
+		notifications <- message
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	type result struct {
+		message Message
+		err     error
+	}
+	results := make([]chan result, 2)
+	for i, channelID := range []string{"a", "b"} {
+		results[i] = make(chan result, 1)
+		go func() {
+			message, err := conn.Send(ctx, &RegisterMessageRequest{MessageType: "register", ChannelID: channelID})
+			results[i] <- result{message, err}
+		}()
+	}
+
+	for i, channelID := range []string{"a", "b"} {
+		result := <-results[i]
+		require.NoError(t, result.err)
+		assert.Equal(t, "https://example.com/"+channelID, result.message.(*RegisterMessageResponse).PushEndpoint)
+	}
+
+	message := <-notifications
+	assert.Equal(t, "1", message.(*NotificationMessage).Version)
+
+	// Pending requests fail once the connection is closed
+	conn.Close()
+	_, err = conn.Send(ctx, &RegisterMessageRequest{MessageType: "register", ChannelID: "c"})
+	assert.Error(t, err)
+}
+
+func TestConnPing(t *testing.T) {
+	_, url := newTestServer(t)
+
+	conn, err := Dial(url)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	messages := make(chan Message, 1)
+	conn.OnMessage(func(message Message) {
+		messages <- message
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = conn.Send(ctx, &HelloMessageRequest{MessageType: "hello", UseWebPush: true})
+	require.NoError(t, err)
+
+	// The service responds to pings in order, before responding to the
+	// following request
+	require.NoError(t, conn.Write(&PingMessage{}))
+	_, err = conn.Send(ctx, &RegisterMessageRequest{MessageType: "register", ChannelID: uuid.NewString()})
+	require.NoError(t, err)
+
+	// Ping responses are not passed to the handler
+	select {
+	case message := <-messages:
+		assert.Failf(t, "unexpected message", "%#v", message)
+	default:
+	}
+
+	// The connection is kept alive
+	select {
+	case <-conn.Done():
+		assert.Fail(t, "connection closed")
+	default:
+	}
+}
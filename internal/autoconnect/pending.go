@@ -0,0 +1,118 @@
+package autoconnect
+
+import (
+	"encoding/base64"
+	"time"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
+	"github.com/google/uuid"
+)
+
+// NewNotification creates a notification delivering a pushed message to a
+// channel. The notification is given a new version.
+func NewNotification(channelID string, request *webpush.PushRequest) *NotificationMessage {
+	message := &NotificationMessage{
+		MessageType: "notification",
+		ChannelID:   channelID,
+		Version:     uuid.NewString(),
+	}
+
+	if len(request.Content) > 0 {
+		message.Data = base64.RawURLEncoding.EncodeToString(request.Content)
+		message.Headers = map[string]string{
+			"encoding": request.ContentEncoding,
+		}
+
+		if request.ContentType != "" {
+			message.Headers["content_type"] = request.ContentType
+		}
+	}
+
+	return message
+}
+
+// Pending holds notifications not yet acknowledged by a user agent, keyed by
+// version, until their TTL expires.
+// The zero value is ready to use. Pending is not safe for concurrent use.
+type Pending struct {
+	notifications map[string]*pendingNotification
+}
+
+type pendingNotification struct {
+	message *NotificationMessage
+	expires time.Time
+}
+
+// Add holds a notification for ttl seconds.
+// A TTL of zero means that the notification is only delivered if the user
+// agent is connected. Such notifications expire right away, but are still
+// recognized when acknowledged until expired notifications are removed.
+// SEE: https://datatracker.ietf.org/doc/html/rfc8030#section-5.2
+func (p *Pending) Add(message *NotificationMessage, ttl int) {
+	if p.notifications == nil {
+		p.notifications = make(map[string]*pendingNotification)
+	}
+
+	p.notifications[message.Version] = &pendingNotification{
+		message: message,
+		expires: time.Now().Add(time.Duration(max(ttl, 0)) * time.Second),
+	}
+}
+
+// Ack removes a notification acknowledged by the user agent. Returns false if
+// no such notification is pending for the channel.
+func (p *Pending) Ack(channelID string, version string) bool {
+	notification, ok := p.notifications[version]
+	if !ok || notification.message.ChannelID != channelID {
+		return false
+	}
+
+	delete(p.notifications, version)
+	return true
+}
+
+// Remove removes a notification. Returns false if it is not pending.
+func (p *Pending) Remove(version string) bool {
+	if _, ok := p.notifications[version]; !ok {
+		return false
+	}
+
+	delete(p.notifications, version)
+	return true
+}
+
+// RemoveChannel removes all notifications of a channel.
+func (p *Pending) RemoveChannel(channelID string) {
+	for version, notification := range p.notifications {
+		if notification.message.ChannelID == channelID {
+			delete(p.notifications, version)
+		}
+	}
+}
+
+// Expire removes expired notifications.
+func (p *Pending) Expire(now time.Time) {
+	for version, notification := range p.notifications {
+		if now.After(notification.expires) {
+			delete(p.notifications, version)
+		}
+	}
+}
+
+// Messages removes expired notifications and returns the rest.
+func (p *Pending) Messages(now time.Time) []*NotificationMessage {
+	p.Expire(now)
+
+	messages := make([]*NotificationMessage, 0, len(p.notifications))
+	for _, notification := range p.notifications {
+		messages = append(messages, notification.message)
+	}
+
+	return messages
+}
+
+// Len returns the number of pending notifications, including expired ones not
+// yet removed.
+func (p *Pending) Len() int {
+	return len(p.notifications)
+}
@@ -0,0 +1,62 @@
+package autoconnect
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewNotification(t *testing.T) {
+	message := NewNotification("1", &webpush.PushRequest{
+		ContentType:     "application/notification+json",
+		ContentEncoding: "aes128gcm",
+		Content:         []byte("Hello, World!"),
+	})
+
+	assert.Equal(t, "notification", message.MessageType)
+	assert.Equal(t, "1", message.ChannelID)
+	assert.NotEmpty(t, message.Version)
+	assert.Equal(t, "SGVsbG8sIFdvcmxkIQ", message.Data)
+	assert.Equal(t, map[string]string{"encoding": "aes128gcm", "content_type": "application/notification+json"}, message.Headers)
+
+	// Messages without content have no headers
+	message = NewNotification("1", &webpush.PushRequest{ContentType: "text/plain"})
+	assert.Empty(t, message.Data)
+	assert.Nil(t, message.Headers)
+}
+
+func TestPending(t *testing.T) {
+	var pending Pending
+
+	// Messages with a TTL of zero expire right away, but may still be acked
+	pending.Add(&NotificationMessage{ChannelID: "1", Version: "z"}, 0)
+	assert.True(t, pending.Ack("1", "z"))
+	pending.Add(&NotificationMessage{ChannelID: "1", Version: "z"}, 0)
+	assert.Empty(t, pending.Messages(time.Now().Add(time.Millisecond)))
+	assert.Equal(t, 0, pending.Len())
+
+	pending.Add(&NotificationMessage{ChannelID: "1", Version: "a"}, 60)
+	pending.Add(&NotificationMessage{ChannelID: "1", Version: "b"}, 60)
+	pending.Add(&NotificationMessage{ChannelID: "2", Version: "c"}, 60)
+	pending.Add(&NotificationMessage{ChannelID: "2", Version: "d"}, 1)
+	require.Equal(t, 4, pending.Len())
+
+	// Expired messages are removed
+	messages := pending.Messages(time.Now().Add(2 * time.Second))
+	assert.Len(t, messages, 3)
+	assert.Equal(t, 3, pending.Len())
+
+	// Acks must match the channel
+	assert.False(t, pending.Ack("2", "a"))
+	assert.True(t, pending.Ack("1", "a"))
+	assert.False(t, pending.Ack("1", "a"))
+
+	assert.True(t, pending.Remove("b"))
+	assert.False(t, pending.Remove("b"))
+
+	pending.RemoveChannel("2")
+	assert.Equal(t, 0, pending.Len())
+}
@@ -0,0 +1,438 @@
+package autoconnect
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+var _ webpush.Pusher = (*Server)(nil)
+
+const (
+	// DefaultMaxUsers is the default maximum number of users of a [Server].
+	DefaultMaxUsers = 10_000
+	// DefaultMaxPending is the default maximum number of notifications kept per
+	// user by a [Server].
+	DefaultMaxPending = 100
+	// DefaultMaxTTL is the default maximum TTL of notifications kept by a
+	// [Server], in seconds. It is the same as that of autopush, 60 days.
+	DefaultMaxTTL = 60 * 24 * 60 * 60
+	// DefaultIdleTimeout is the default time after which users that have not
+	// connected to a [Server] are removed.
+	DefaultIdleTimeout = 60 * 24 * time.Hour
+)
+
+// Server implements the server side of Mozilla's autoconnect protocol,
+// letting user agents such as Firefox (using dom.push.serverURL) or [Client]
+// use a self-hosted push service.
+// Server implements [webpush.Pusher] and is meant to be used with a
+// [webpush.PushServer] serving the push endpoints.
+// All state is kept in memory.
+type Server struct {
+	// Endpoint is the base URL of push endpoints, such as
+	// "https://example.com/push". Each subscription's endpoint is the base URL
+	// followed by a slash and the subscription's token.
+	Endpoint string
+	// MaxUsers is the maximum number of users. User agents connecting without
+	// a known UAID are turned away once reached. Defaults to [DefaultMaxUsers].
+	MaxUsers int
+	// MaxPending is the maximum number of notifications kept per user. Pushes
+	// fail with [webpush.ErrDeliveryFailed] once reached. Defaults to
+	// [DefaultMaxPending].
+	MaxPending int
+	// MaxTTL is the maximum time notifications are kept, in seconds. Longer TTLs
+	// are reduced. Defaults to [DefaultMaxTTL].
+	MaxTTL int
+	// IdleTimeout is the time after which users that have not connected are
+	// removed, see [Server.Prune]. Defaults to [DefaultIdleTimeout].
+	IdleTimeout time.Duration
+
+	upgrader websocket.Upgrader
+
+	mutex sync.Mutex
+	// users maps UAIDs to users.
+	users map[string]*serverUser
+	// tokens maps push endpoint tokens to channels.
+	tokens map[string]serverChannel
+}
+
+type serverUser struct {
+	uaid string
+	// channels maps channel IDs to push endpoint tokens.
+	channels map[string]string
+	// pending holds notifications not yet acknowledged.
+	pending Pending
+	conn    *serverConn
+	// lastSeen is the time the user was last connected.
+	lastSeen time.Time
+}
+
+type serverChannel struct {
+	uaid      string
+	channelID string
+}
+
+type serverConn struct {
+	mutex sync.Mutex
+	conn  *websocket.Conn
+}
+
+func (c *serverConn) Write(message Message) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.conn.WriteJSON(message)
+}
+
+// NewServer creates a new [Server] serving push endpoints under endpoint.
+func NewServer(endpoint string) *Server {
+	return &Server{
+		Endpoint:    strings.TrimSuffix(endpoint, "/"),
+		MaxUsers:    DefaultMaxUsers,
+		MaxPending:  DefaultMaxPending,
+		MaxTTL:      DefaultMaxTTL,
+		IdleTimeout: DefaultIdleTimeout,
+
+		upgrader: websocket.Upgrader{
+			Subprotocols: []string{"push-notification"},
+			// User agents connect from privileged contexts without an origin
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+
+		users:  make(map[string]*serverUser),
+		tokens: make(map[string]serverChannel),
+	}
+}
+
+// ServeHTTP serves the autoconnect WebSocket.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Error("Failed to upgrade WebSocket", slog.Any("error", err))
+		return
+	}
+	defer conn.Close()
+
+	c := &serverConn{conn: conn}
+
+	var user *serverUser
+	defer func() {
+		if user != nil {
+			s.mutex.Lock()
+			if user.conn == c {
+				user.conn = nil
+				user.lastSeen = time.Now()
+				// There is nothing worth resuming for users without channels
+				if len(user.channels) == 0 && s.users[user.uaid] == user {
+					s.removeUser(user)
+				}
+			}
+			s.mutex.Unlock()
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				slog.Debug("Failed to read message", slog.Any("error", err))
+			}
+			return
+		}
+
+		var envelope struct {
+			MessageType string `json:"messageType"`
+		}
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			slog.Warn("Failed to parse message", slog.Any("error", err))
+			return
+		}
+
+		// The first message must be a hello
+		if user == nil && envelope.MessageType != "hello" {
+			slog.Warn("Got message before hello", slog.String("messageType", envelope.MessageType))
+			return
+		}
+
+		switch envelope.MessageType {
+		case "", "ping":
+			err = c.Write(&PingMessage{})
+		case "hello":
+			var request HelloMessageRequest
+			if err := json.Unmarshal(data, &request); err != nil {
+				slog.Warn("Failed to parse message", slog.Any("error", err))
+				return
+			}
+
+			if user != nil {
+				slog.Warn("Got repeated hello")
+				return
+			}
+
+			user, err = s.hello(c, &request)
+		case "register":
+			var request RegisterMessageRequest
+			if err := json.Unmarshal(data, &request); err != nil {
+				slog.Warn("Failed to parse message", slog.Any("error", err))
+				return
+			}
+
+			err = c.Write(s.register(user, &request))
+		case "unregister":
+			var request UnregisterMessageRequest
+			if err := json.Unmarshal(data, &request); err != nil {
+				slog.Warn("Failed to parse message", slog.Any("error", err))
+				return
+			}
+
+			err = c.Write(s.unregister(user, &request))
+		case "ack":
+			var request AckMessageRequest
+			if err := json.Unmarshal(data, &request); err != nil {
+				slog.Warn("Failed to parse message", slog.Any("error", err))
+				return
+			}
+
+			s.ack(user, &request)
+		case "nack":
+			var request NackMessageRequest
+			if err := json.Unmarshal(data, &request); err != nil {
+				slog.Warn("Failed to parse message", slog.Any("error", err))
+				return
+			}
+
+			slog.Debug("Got nack", slog.String("uaid", user.uaid), slog.String("version", request.Version), slog.Int("code", request.Code))
+		case "broadcast_subscribe":
+			// Broadcasts are not supported, there are never any changes
+		default:
+			slog.Warn("Got unknown message", slog.String("messageType", envelope.MessageType))
+		}
+		if err != nil {
+			slog.Error("Failed to handle message", slog.String("messageType", envelope.MessageType), slog.Any("error", err))
+			return
+		}
+	}
+}
+
+// hello resumes or creates a user, delivering any pending notifications.
+// As done by autopush, the user is reset if the user agent's view of the
+// registered channels differs from the server's, making the user agent
+// register its channels anew.
+func (s *Server) hello(c *serverConn, request *HelloMessageRequest) (*serverUser, error) {
+	now := time.Now()
+
+	s.mutex.Lock()
+	var previous *serverConn
+	user, ok := s.users[request.UAID]
+	if ok && !user.hasChannels(request.ChannelIDs) {
+		slog.Debug("Resetting user with mismatched channels", slog.String("uaid", user.uaid))
+		previous = user.conn
+		s.removeUser(user)
+		ok = false
+	}
+
+	if !ok {
+		if len(s.users) >= s.MaxUsers {
+			s.prune(now)
+		}
+
+		if len(s.users) >= s.MaxUsers {
+			s.mutex.Unlock()
+			if previous != nil {
+				previous.conn.Close()
+			}
+
+			err := c.Write(&HelloMessageResponse{
+				MessageType: "hello",
+				Status:      503,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			return nil, errors.New("too many users")
+		}
+
+		// Unknown or no UAID, the user agent will have to register its channels
+		// anew
+		user = &serverUser{
+			uaid:     strings.ReplaceAll(uuid.NewString(), "-", ""),
+			channels: make(map[string]string),
+		}
+		s.users[user.uaid] = user
+	} else {
+		// Only a single connection is allowed per user
+		previous = user.conn
+	}
+
+	user.conn = c
+	user.lastSeen = now
+
+	pending := user.pending.Messages(now)
+	s.mutex.Unlock()
+
+	if previous != nil {
+		previous.conn.Close()
+	}
+
+	err := c.Write(&HelloMessageResponse{
+		MessageType: "hello",
+		UAID:        user.uaid,
+		Status:      200,
+		UseWebPush:  true,
+		Broadcasts:  make(map[string]string),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, message := range pending {
+		if err := c.Write(message); err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+// hasChannels returns true if channelIDs are the user's registered channels.
+func (u *serverUser) hasChannels(channelIDs []string) bool {
+	if len(channelIDs) != len(u.channels) {
+		return false
+	}
+
+	for _, channelID := range channelIDs {
+		if _, ok := u.channels[channelID]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// removeUser removes a user and its push endpoints. Must be called with the
+// mutex held.
+func (s *Server) removeUser(user *serverUser) {
+	for _, token := range user.channels {
+		delete(s.tokens, token)
+	}
+
+	delete(s.users, user.uaid)
+}
+
+// Prune removes users that have not connected since [Server.IdleTimeout],
+// along with their push endpoints and pending notifications.
+func (s *Server) Prune(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.prune(now)
+}
+
+// prune implements [Server.Prune]. Must be called with the mutex held.
+func (s *Server) prune(now time.Time) {
+	for _, user := range s.users {
+		if user.conn == nil && now.Sub(user.lastSeen) > s.IdleTimeout {
+			slog.Debug("Removing idle user", slog.String("uaid", user.uaid))
+			s.removeUser(user)
+		}
+	}
+}
+
+func (s *Server) register(user *serverUser, request *RegisterMessageRequest) *RegisterMessageResponse {
+	response := &RegisterMessageResponse{
+		MessageType: "register",
+		ChannelID:   request.ChannelID,
+	}
+
+	if _, err := uuid.Parse(request.ChannelID); err != nil {
+		response.Status = 400
+		return response
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	token, ok := user.channels[request.ChannelID]
+	if !ok {
+		token = strings.ReplaceAll(uuid.NewString(), "-", "")
+		user.channels[request.ChannelID] = token
+		s.tokens[token] = serverChannel{uaid: user.uaid, channelID: request.ChannelID}
+	}
+
+	response.Status = 200
+	response.PushEndpoint = s.Endpoint + "/" + token
+	return response
+}
+
+func (s *Server) unregister(user *serverUser, request *UnregisterMessageRequest) *UnregisterMessageResponse {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if token, ok := user.channels[request.ChannelID]; ok {
+		delete(user.channels, request.ChannelID)
+		delete(s.tokens, token)
+	}
+
+	user.pending.RemoveChannel(request.ChannelID)
+
+	return &UnregisterMessageResponse{
+		MessageType: "unregister",
+		ChannelID:   request.ChannelID,
+		Status:      200,
+	}
+}
+
+func (s *Server) ack(user *serverUser, request *AckMessageRequest) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, update := range request.Updates {
+		user.pending.Ack(update.ChannelID, update.Version)
+	}
+}
+
+// Push implements webpush.Pusher.
+// Messages are kept until acknowledged by the user agent, or until their TTL
+// expires. Returns [webpush.ErrSubscriptionNotFound] for unknown tokens.
+func (s *Server) Push(request *webpush.PushRequest) error {
+	s.mutex.Lock()
+	channel, ok := s.tokens[request.Token]
+	if !ok {
+		s.mutex.Unlock()
+		return webpush.ErrSubscriptionNotFound
+	}
+
+	message := NewNotification(channel.channelID, request)
+
+	user := s.users[channel.uaid]
+	conn := user.conn
+
+	user.pending.Expire(time.Now())
+	if request.TTL > 0 && user.pending.Len() >= s.MaxPending {
+		s.mutex.Unlock()
+		return fmt.Errorf("%w: too many pending notifications", webpush.ErrDeliveryFailed)
+	}
+
+	user.pending.Add(message, min(request.TTL, s.MaxTTL))
+	s.mutex.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+
+	if err := conn.Write(message); err != nil {
+		// The message is delivered when the user agent reconnects
+		slog.Warn("Failed to deliver notification", slog.String("uaid", channel.uaid), slog.Any("error", err))
+	}
+
+	return nil
+}
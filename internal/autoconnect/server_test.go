@@ -0,0 +1,405 @@
+package autoconnect
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/webpush"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer serves a Server and its push endpoints, returning the
+// WebSocket URL.
+func newTestServer(t *testing.T) (*Server, string) {
+	mux := http.NewServeMux()
+	httpServer := httptest.NewServer(mux)
+	t.Cleanup(httpServer.Close)
+
+	server := NewServer(httpServer.URL + "/push")
+	mux.Handle("/push/", webpush.NewPushServer(server))
+	mux.Handle("/", server)
+
+	return server, "ws" + strings.TrimPrefix(httpServer.URL, "http")
+}
+
+// newTestClient connects a client and a push manager to the server.
+func newTestClient(t *testing.T, url string) (*Client, *webpush.PushManager) {
+	client := NewClient(url, "", nil)
+	t.Cleanup(func() { client.Close() })
+
+	pushManager := webpush.NewPushManager(client, webpush.NewMemorySubscriptionStore())
+	require.NoError(t, client.Connect())
+
+	return client, pushManager
+}
+
+func pendingNotifications(server *Server, uaid string) int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.users[uaid].pending.Len()
+}
+
+func TestServerPush(t *testing.T) {
+	server, url := newTestServer(t)
+	client, pushManager := newTestClient(t, url)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	messages := pushManager.Messages(ctx)
+
+	applicationServer, err := webpush.NewApplicationServer()
+	require.NoError(t, err)
+
+	subscription, err := pushManager.Subscribe(applicationServer.PublicECDH())
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(subscription.Endpoint, server.Endpoint+"/"))
+
+	target, err := subscription.PushTarget()
+	require.NoError(t, err)
+
+	notification := webpush.DeclerativePushNotification{
+		Title:    "Hello, World!",
+		Navigate: "https://example.com",
+	}
+	err = applicationServer.PushNotification(ctx, target, notification, &webpush.PushOptions{TTL: 60})
+	require.NoError(t, err)
+
+	select {
+	case event := <-messages:
+		assert.Equal(t, subscription.ID, event.SubscriptionID)
+		// The content type is passed on by the server, to the client
+		assert.Equal(t, "application/notification+json", event.ContentType)
+		require.NotNil(t, event.Notification)
+		assert.Equal(t, "Hello, World!", event.Notification.Notification.Title)
+	case <-ctx.Done():
+		require.FailNow(t, "timed out waiting for message")
+	}
+
+	// Delivered messages are acked
+	assert.Eventually(t, func() bool {
+		return pendingNotifications(server, client.UAID()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServerUnregister(t *testing.T) {
+	_, url := newTestServer(t)
+	_, pushManager := newTestClient(t, url)
+
+	applicationServer, err := webpush.NewApplicationServer()
+	require.NoError(t, err)
+
+	subscription, err := pushManager.Subscribe(applicationServer.PublicECDH())
+	require.NoError(t, err)
+
+	err = pushManager.Unsubscribe(subscription.ID)
+	require.NoError(t, err)
+
+	target, err := subscription.PushTarget()
+	require.NoError(t, err)
+
+	// The push endpoint is gone
+	err = applicationServer.Push(context.TODO(), target, []byte("Hello, World!"), &webpush.PushOptions{TTL: 60})
+	assert.ErrorContains(t, err, "410")
+}
+
+func TestServerResume(t *testing.T) {
+	server, url := newTestServer(t)
+	client, pushManager := newTestClient(t, url)
+	uaid := client.UAID()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	messages := pushManager.Messages(ctx)
+
+	applicationServer, err := webpush.NewApplicationServer()
+	require.NoError(t, err)
+
+	subscription, err := pushManager.Subscribe(applicationServer.PublicECDH())
+	require.NoError(t, err)
+
+	// Lose the connection and wait for the server to notice
+	conn, err := client.getConn()
+	require.NoError(t, err)
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		return server.users[uaid].conn == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	target, err := subscription.PushTarget()
+	require.NoError(t, err)
+
+	// The message is kept until the client reconnects
+	err = applicationServer.Push(ctx, target, []byte("Hello, World!"), &webpush.PushOptions{TTL: 60, ContentType: "text/plain"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, pendingNotifications(server, uaid))
+
+	select {
+	case event := <-messages:
+		assert.Equal(t, subscription.ID, event.SubscriptionID)
+		assert.Equal(t, "text/plain", event.ContentType)
+		assert.Equal(t, []byte("Hello, World!"), event.Content)
+	case <-ctx.Done():
+		require.FailNow(t, "timed out waiting for message")
+	}
+
+	assert.Equal(t, uaid, client.UAID())
+}
+
+func TestServerResumeStoredSession(t *testing.T) {
+	server, url := newTestServer(t)
+
+	applicationServer, err := webpush.NewApplicationServer()
+	require.NoError(t, err)
+
+	// A first run creates a subscription, persisted in the store
+	store := webpush.NewMemorySubscriptionStore()
+	client := NewClient(url, "", nil)
+	pushManager := webpush.NewPushManager(client, store)
+	require.NoError(t, client.Connect())
+	uaid := client.UAID()
+
+	subscription, err := pushManager.Subscribe(applicationServer.PublicECDH())
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+
+	target, err := subscription.PushTarget()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Pushed while no client is running
+	assert.Eventually(t, func() bool {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		return server.users[uaid].conn == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	err = applicationServer.Push(ctx, target, []byte("Hello, World!"), &webpush.PushOptions{TTL: 60})
+	require.NoError(t, err)
+
+	// A later run resumes the session using the stored subscriptions
+	subscriptions, err := store.List()
+	require.NoError(t, err)
+	channels := make(map[string]string)
+	for _, subscription := range subscriptions {
+		channels[subscription.ID] = subscription.Keys.P256DH
+	}
+
+	client = NewClient(url, uaid, channels)
+	t.Cleanup(func() { client.Close() })
+	pushManager = webpush.NewPushManager(client, store)
+	messages := pushManager.Messages(ctx)
+	require.NoError(t, client.Connect())
+	assert.Equal(t, uaid, client.UAID())
+
+	// The pending message is delivered on connect, decrypted using the stored
+	// keys
+	select {
+	case event := <-messages:
+		assert.Equal(t, subscription.ID, event.SubscriptionID)
+		assert.Equal(t, []byte("Hello, World!"), event.Content)
+	case <-ctx.Done():
+		require.FailNow(t, "timed out waiting for message")
+	}
+}
+
+func TestServerReregister(t *testing.T) {
+	_, url := newTestServer(t)
+
+	applicationServer, err := webpush.NewApplicationServer()
+	require.NoError(t, err)
+
+	// A first run creates a subscription, persisted in the store
+	store := webpush.NewMemorySubscriptionStore()
+	client := NewClient(url, "", nil)
+	pushManager := webpush.NewPushManager(client, store)
+	require.NoError(t, client.Connect())
+	uaid := client.UAID()
+
+	subscription, err := pushManager.Subscribe(applicationServer.PublicECDH())
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+
+	// A later run resumes the session using a service that has lost its state
+	server, url := newTestServer(t)
+
+	subscriptions, err := store.List()
+	require.NoError(t, err)
+	channels := make(map[string]string)
+	for _, subscription := range subscriptions {
+		channels[subscription.ID] = subscription.Keys.P256DH
+	}
+
+	client = NewClient(url, uaid, channels)
+	t.Cleanup(func() { client.Close() })
+	pushManager = webpush.NewPushManager(client, store)
+
+	changes := make(chan webpush.SubscriptionChange, 1)
+	pushManager.OnSubscriptionChange(func(change webpush.SubscriptionChange) {
+		changes <- change
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	messages := pushManager.Messages(ctx)
+
+	// The service assigns a new UAID and the channels are registered anew
+	// before connecting completes
+	require.NoError(t, client.Connect())
+	assert.NotEqual(t, uaid, client.UAID())
+
+	var change webpush.SubscriptionChange
+	select {
+	case change = <-changes:
+	default:
+		require.FailNow(t, "expected the subscription to change")
+	}
+	assert.Equal(t, subscription.Endpoint, change.Old.Endpoint)
+	assert.True(t, strings.HasPrefix(change.New.Endpoint, server.Endpoint+"/"))
+
+	stored, err := store.Get(subscription.ID)
+	require.NoError(t, err)
+	assert.Equal(t, change.New.Endpoint, stored.Endpoint)
+
+	// Messages are delivered using the new endpoint
+	target, err := change.New.PushTarget()
+	require.NoError(t, err)
+
+	err = applicationServer.Push(ctx, target, []byte("Hello, World!"), &webpush.PushOptions{TTL: 60})
+	require.NoError(t, err)
+
+	select {
+	case event := <-messages:
+		assert.Equal(t, subscription.ID, event.SubscriptionID)
+		assert.Equal(t, []byte("Hello, World!"), event.Content)
+	case <-ctx.Done():
+		require.FailNow(t, "timed out waiting for message")
+	}
+}
+
+func TestServerPing(t *testing.T) {
+	_, url := newTestServer(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	require.NoError(t, conn.WriteJSON(&HelloMessageRequest{MessageType: "hello", UseWebPush: true}))
+	var hello HelloMessageResponse
+	require.NoError(t, conn.ReadJSON(&hello))
+	assert.Equal(t, 200, hello.Status)
+
+	// Pings are echoed
+	require.NoError(t, conn.WriteJSON(&PingMessage{}))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.JSONEq(t, "{}", string(data))
+}
+
+// helloTestConn connects to the server and says hello, returning the
+// connection and the response.
+func helloTestConn(t *testing.T, url string, request *HelloMessageRequest) (*websocket.Conn, *HelloMessageResponse) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	request.MessageType = "hello"
+	request.UseWebPush = true
+	require.NoError(t, conn.WriteJSON(request))
+
+	var hello HelloMessageResponse
+	require.NoError(t, conn.ReadJSON(&hello))
+	return conn, &hello
+}
+
+func TestServerHelloChannels(t *testing.T) {
+	server, url := newTestServer(t)
+
+	conn, hello := helloTestConn(t, url, &HelloMessageRequest{})
+	require.Equal(t, 200, hello.Status)
+	uaid := hello.UAID
+
+	channelID := "6c6e7a2f-3b0e-4a0e-9d5e-0c9e5b3f2d1a"
+	require.NoError(t, conn.WriteJSON(&RegisterMessageRequest{MessageType: "register", ChannelID: channelID}))
+	var register RegisterMessageResponse
+	require.NoError(t, conn.ReadJSON(&register))
+	require.Equal(t, 200, register.Status)
+	token := strings.TrimPrefix(register.PushEndpoint, server.Endpoint+"/")
+	conn.Close()
+
+	// The same channels resume the user
+	conn, hello = helloTestConn(t, url, &HelloMessageRequest{UAID: uaid, ChannelIDs: []string{channelID}})
+	require.Equal(t, 200, hello.Status)
+	assert.Equal(t, uaid, hello.UAID)
+	conn.Close()
+
+	// Other channels reset the user, removing its push endpoints
+	_, hello = helloTestConn(t, url, &HelloMessageRequest{UAID: uaid, ChannelIDs: []string{channelID, "0c9e5b3f-2d1a-4a0e-9d5e-6c6e7a2f3b0e"}})
+	require.Equal(t, 200, hello.Status)
+	assert.NotEqual(t, uaid, hello.UAID)
+
+	err := server.Push(&webpush.PushRequest{Token: token, TTL: 60})
+	assert.ErrorIs(t, err, webpush.ErrSubscriptionNotFound)
+}
+
+func TestServerLimits(t *testing.T) {
+	server, url := newTestServer(t)
+	server.MaxUsers = 1
+	server.MaxPending = 2
+	server.MaxTTL = 10
+
+	conn, hello := helloTestConn(t, url, &HelloMessageRequest{})
+	require.Equal(t, 200, hello.Status)
+	uaid := hello.UAID
+
+	require.NoError(t, conn.WriteJSON(&RegisterMessageRequest{MessageType: "register", ChannelID: "6c6e7a2f-3b0e-4a0e-9d5e-0c9e5b3f2d1a"}))
+	var register RegisterMessageResponse
+	require.NoError(t, conn.ReadJSON(&register))
+	require.Equal(t, 200, register.Status)
+	token := strings.TrimPrefix(register.PushEndpoint, server.Endpoint+"/")
+	conn.Close()
+
+	// New users are turned away once full
+	_, hello = helloTestConn(t, url, &HelloMessageRequest{})
+	assert.Equal(t, 503, hello.Status)
+
+	// Pending notifications are limited
+	assert.Eventually(t, func() bool {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		return server.users[uaid].conn == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, server.Push(&webpush.PushRequest{Token: token, TTL: 60}))
+	require.NoError(t, server.Push(&webpush.PushRequest{Token: token, TTL: 60}))
+	err := server.Push(&webpush.PushRequest{Token: token, TTL: 60})
+	assert.ErrorIs(t, err, webpush.ErrDeliveryFailed)
+
+	// TTLs are reduced
+	server.mutex.Lock()
+	for _, message := range server.users[uaid].pending.Messages(time.Now()) {
+		assert.WithinDuration(t, time.Now().Add(10*time.Second), server.users[uaid].pending.notifications[message.Version].expires, time.Second)
+	}
+	server.mutex.Unlock()
+
+	// Idle users are removed
+	server.Prune(time.Now())
+	assert.Equal(t, 2, pendingNotifications(server, uaid))
+
+	server.Prune(time.Now().Add(DefaultIdleTimeout + time.Second))
+	err = server.Push(&webpush.PushRequest{Token: token, TTL: 60})
+	assert.ErrorIs(t, err, webpush.ErrSubscriptionNotFound)
+
+	_, hello = helloTestConn(t, url, &HelloMessageRequest{})
+	assert.Equal(t, 200, hello.Status)
+}
@@ -7,17 +7,56 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/big"
+	"strings"
 	"time"
 )
 
 const AuthorizationScheme = "vapid"
 
+// MaxTokenLifetime is the maximum time until a token may expire.
+// SEE: https://datatracker.ietf.org/doc/html/rfc8292#section-2
+const MaxTokenLifetime = 24 * time.Hour
+
 func FormatAuthorizationHeader(token string, key *ecdsa.PublicKey) string {
 	k := base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), key.X, key.Y))
 	return fmt.Sprintf("%s t=%s, k=%s", AuthorizationScheme, token, k)
 }
 
+// ParseAuthorizationHeader parses a "vapid" Authorization header, returning
+// the JWT and the Base64 URL-encoded public key of the application server.
+// The token is not verified.
+// SEE: https://datatracker.ietf.org/doc/html/rfc8292#section-3
+func ParseAuthorizationHeader(header string) (string, string, error) {
+	scheme, parameters, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, AuthorizationScheme) {
+		return "", "", fmt.Errorf("invalid authorization scheme")
+	}
+
+	var token, key string
+	for _, parameter := range strings.Split(parameters, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(parameter), "=")
+		if !ok {
+			return "", "", fmt.Errorf("invalid authorization parameter")
+		}
+
+		switch strings.ToLower(name) {
+		case "t":
+			token = value
+		case "k":
+			key = value
+		}
+	}
+
+	if token == "" || key == "" {
+		return "", "", fmt.Errorf("missing authorization parameter")
+	}
+
+	return token, key, nil
+}
+
 // NewToken creates a new VAPID JWT.
 // - expires MUST be less than 24 hours.
 func NewToken(audience string, expires time.Time, subject string, key *ecdsa.PrivateKey) (string, error) {
@@ -58,3 +97,84 @@ func NewToken(audience string, expires time.Time, subject string, key *ecdsa.Pri
 
 	return jwt + "." + base64.RawURLEncoding.EncodeToString(signature), nil
 }
+
+// VerifyToken verifies a VAPID JWT, as found in an Authorization header parsed
+// using [ParseAuthorizationHeader]. The token must be signed using ES256 by
+// key, the Base64 URL-encoded public key of the application server, be
+// intended for audience, the origin of the push resource, and not be expired
+// at now.
+// SEE: https://datatracker.ietf.org/doc/html/rfc8292#section-2
+func VerifyToken(token string, key string, audience string, now time.Time) error {
+	keyBytes, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("invalid key: %w", err)
+	}
+
+	x, y := elliptic.Unmarshal(elliptic.P256(), keyBytes)
+	if x == nil {
+		return errors.New("invalid key: not an uncompressed P-256 point")
+	}
+	publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("invalid token: expected three parts")
+	}
+
+	// SEE: https://datatracker.ietf.org/doc/html/rfc7518#section-3.4
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		return errors.New("invalid token: invalid signature")
+	}
+
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(publicKey, hash[:], r, s) {
+		return errors.New("invalid token: invalid signature")
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return fmt.Errorf("invalid token: %w", err)
+	}
+
+	if header.Algorithm != "ES256" {
+		return fmt.Errorf("invalid token: unsupported algorithm %q", header.Algorithm)
+	}
+
+	var claims struct {
+		Audience string `json:"aud"`
+		Expires  int64  `json:"exp"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return fmt.Errorf("invalid token: %w", err)
+	}
+
+	if claims.Audience != audience {
+		return fmt.Errorf("invalid token: unexpected audience %q", claims.Audience)
+	}
+
+	expires := time.Unix(claims.Expires, 0)
+	if !now.Before(expires) {
+		return errors.New("invalid token: expired")
+	}
+
+	if expires.Sub(now) > MaxTokenLifetime {
+		return errors.New("invalid token: expires too far into the future")
+	}
+
+	return nil
+}
+
+// decodeSegment decodes a Base64 URL-encoded JSON segment of a JWT.
+func decodeSegment(segment string, v any) error {
+	bytes, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(bytes, v)
+}
@@ -8,6 +8,7 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -103,10 +104,15 @@ func (p PushTarget) Audience() (string, error) {
 	return u.Scheme + "://" + u.Host, nil
 }
 
+// MaxContentSize is the maximum size of a push message's plaintext content.
+// The 4096B a push service must support, minus the 86B header, 16B
+// authentication tag and 1B padding delimiter.
+// SEE: https://www.rfc-editor.org/rfc/rfc8291.html#section-4
+const MaxContentSize = 3993
+
 func (a *ApplicationServer) Push(ctx context.Context, target *PushTarget, content []byte, options *PushOptions) error {
-	// SEE: https://www.rfc-editor.org/rfc/rfc8291.html#section-4
-	if len(content) > 3993 {
-		return fmt.Errorf("record size is too large - cannot exceed 3993B")
+	if len(content) > MaxContentSize {
+		return fmt.Errorf("record size is too large - cannot exceed %dB", MaxContentSize)
 	}
 
 	audience, err := target.Audience()
@@ -193,3 +199,36 @@ func (a *ApplicationServer) Push(ctx context.Context, target *PushTarget, conten
 
 	return nil
 }
+
+// PushNotification pushes a declarative push message holding notification.
+// The notification is validated before it's sent, returning
+// [ValidationErrors] if it's invalid. The Content-Type option is always set
+// to application/notification+json.
+// SEE: https://pr-preview.s3.amazonaws.com/w3c/push-api/pull/385.html#declarative-push-message
+func (a *ApplicationServer) PushNotification(ctx context.Context, target *PushTarget, notification DeclerativePushNotification, options *PushOptions) error {
+	message := DeclerativePushMessage{
+		WebPush:      8030,
+		Notification: notification,
+	}
+
+	if err := message.Validate(); err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(&message)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+
+	if len(content) > MaxContentSize {
+		return fmt.Errorf("encoded notification is too large - %dB exceeds the limit of %dB", len(content), MaxContentSize)
+	}
+
+	var pushOptions PushOptions
+	if options != nil {
+		pushOptions = *options
+	}
+	pushOptions.ContentType = "application/notification+json"
+
+	return a.Push(ctx, target, content, &pushOptions)
+}
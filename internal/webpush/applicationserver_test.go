@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/AlexGustafsson/web-push-poc/internal/aes128gcm"
@@ -67,6 +68,51 @@ func TestApplicationServerPushContent(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestApplicationServerPushNotification(t *testing.T) {
+	userAgentPublicKey := "BAgmPAlNFAEASIyxob47Ov6ftM2f1Cb6WR60zKP5UZSA9ah507JHtsUA0GsOxkMo6KUgwHc1pU7Gj5UlSESITTg"
+	authenticationSecret := "uEMWDVY9OhnL-QwUZlKNRg"
+
+	applicationServer, err := NewApplicationServer()
+	require.NoError(t, err)
+
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	subscription := Subscription{
+		Endpoint: server.URL,
+		Keys: SubscriptionKeys{
+			P256DH: userAgentPublicKey,
+			Auth:   authenticationSecret,
+		},
+	}
+
+	target, err := subscription.PushTarget()
+	require.NoError(t, err)
+
+	notification := DeclerativePushNotification{
+		Title:    "Hello, World!",
+		Navigate: "https://example.com",
+	}
+
+	err = applicationServer.PushNotification(context.TODO(), target, notification, &PushOptions{ContentType: "text/plain"})
+	require.NoError(t, err)
+	assert.Equal(t, "application/notification+json", contentType)
+
+	// Invalid notifications are not sent
+	var validationErrors ValidationErrors
+	err = applicationServer.PushNotification(context.TODO(), target, DeclerativePushNotification{Title: "Hello, World!"}, nil)
+	assert.ErrorAs(t, err, &validationErrors)
+
+	// Too large notifications are not sent
+	notification.Body = strings.Repeat("a", MaxContentSize)
+	err = applicationServer.PushNotification(context.TODO(), target, notification, nil)
+	assert.ErrorContains(t, err, "too large")
+}
+
 func parsePrivateKey(t *testing.T, k string) *ecdh.PrivateKey {
 	bytes := parseBytes(t, k)
 
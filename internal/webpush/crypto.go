@@ -5,6 +5,9 @@ import (
 	"crypto/ecdh"
 	"crypto/hkdf"
 	"crypto/sha256"
+	"fmt"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/aes128gcm"
 )
 
 // TODO: Rewrite? Split up?
@@ -34,3 +37,66 @@ func DeriveInputKeyingMaterial(
 
 	return hkdf.Key(sha256.New, sharedSecret, authenticationSecret, info.String(), 32)
 }
+
+// DecryptMessage decrypts a push message sent to a subscription.
+func DecryptMessage(userAgentPrivateKey *ecdh.PrivateKey, authenticationSecret []byte, message []byte) ([]byte, error) {
+	var header aes128gcm.Header
+	if err := header.UnmarshalBinary(message); err != nil {
+		return nil, err
+	}
+
+	// Ephemeral sender key
+	senderPublicKey, err := ecdh.P256().NewPublicKey(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	// NOTE: "as_public" is the application server's ephemeral key, not its
+	// VAPID key
+	// SEE: https://www.rfc-editor.org/rfc/rfc8291.html#section-3.4
+	ikm, err := DeriveInputKeyingMaterial(
+		userAgentPrivateKey, senderPublicKey,
+		userAgentPrivateKey.PublicKey(), senderPublicKey,
+		authenticationSecret,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return aes128gcm.Decrypt(message, ikm)
+}
+
+// ValidateMessage checks that an encrypted push message conforms to the
+// constraints RFC 8291 places on the "aes128gcm" content coding, without
+// decrypting it.
+// SEE: https://www.rfc-editor.org/rfc/rfc8291.html#section-4
+func ValidateMessage(message []byte) error {
+	var header aes128gcm.Header
+	if err := header.UnmarshalBinary(message); err != nil {
+		return fmt.Errorf("invalid aes128gcm header: %w", err)
+	}
+
+	// The "keyid" parameter MUST contain the uncompressed P-256 public key of
+	// the application server
+	if len(header.KeyID) != 65 || header.KeyID[0] != 0x04 {
+		return fmt.Errorf("invalid aes128gcm key id: expected an uncompressed P-256 public key")
+	}
+
+	if _, err := ecdh.P256().NewPublicKey(header.KeyID); err != nil {
+		return fmt.Errorf("invalid aes128gcm key id: %w", err)
+	}
+
+	// An application server MUST encrypt a push message with a single record,
+	// meaning the record size must cover the entire body. A record always
+	// holds at least a padding delimiter octet and a 16-octet authentication tag
+	recordLength := len(message) - header.Length()
+	if recordLength < 17 {
+		return fmt.Errorf("invalid aes128gcm body: expected a single record")
+	}
+
+	if recordLength > int(header.RecordSize) {
+		return fmt.Errorf("invalid aes128gcm body: expected a single record, record size is smaller than the body")
+	}
+
+	return nil
+}
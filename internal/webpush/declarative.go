@@ -1,38 +1,390 @@
 package webpush
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// DeclerativePushMessage is a push message that the user agent can display
+// as a notification without involving the application.
+// Members not modeled by the type are kept in Extra and written back when
+// encoding the message.
 // SEE: https://pr-preview.s3.amazonaws.com/w3c/push-api/pull/385.html#declarative-push-message
 type DeclerativePushMessage struct {
 	// WebPush MUST be set to 8030.
 	WebPush      int                         `json:"web_push"`
 	Notification DeclerativePushNotification `json:"notification"`
-	AppBadge     uint64                      `json:"app_badge,omitempty"`
-	Mutable      *bool                       `json:"mutable,omitempty"`
+	// Navigate is an optional, top-level navigation URL. If set, it MUST be an
+	// absolute https URL. The notification's navigation URL takes precedence.
+	Navigate string `json:"navigate,omitempty"`
+	// AppBadge, if set, updates the application's badge. Zero clears the badge,
+	// which is why the field is a pointer.
+	// SEE: https://w3c.github.io/badging/
+	AppBadge *uint64 `json:"app_badge,omitempty"`
+	// Mutable indicates that the application's service worker may modify the
+	// notification before it's displayed. The notification is displayed as-is
+	// if not.
+	Mutable *bool `json:"mutable,omitempty"`
+
+	// Extra holds unknown members.
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
+// Direction is the text direction of a notification.
+// SEE: https://notifications.spec.whatwg.org/#enumdef-notificationdirection
+type Direction string
+
+const (
+	DirectionAuto        Direction = "auto"
+	DirectionLeftToRight Direction = "ltr"
+	DirectionRightToLeft Direction = "rtl"
+)
+
+// DeclerativePushNotification holds the notification of a
+// [DeclerativePushMessage]. The members mirror the web's NotificationOptions.
 // SEE: https://pr-preview.s3.amazonaws.com/w3c/push-api/pull/385.html#declarative-push-message
+// SEE: https://notifications.spec.whatwg.org/#dictdef-notificationoptions
 type DeclerativePushNotification struct {
-	Title              string                              `json:"title"`
-	Navigate           string                              `json:"navigate"`
-	Language           string                              `json:"lang,omitempty"`
-	Direction          string                              `json:"ltr,omitempty"`
-	Body               string                              `json:"body,omitempty"`
-	Tag                string                              `json:"tag,omitempty"`
-	Image              string                              `json:"image,omitempty"`
-	Icon               string                              `json:"icon,omitempty"`
-	Badge              string                              `json:"badge,omitempty"`
-	Vibrate            []int                               `json:"vibrate,omitempty"`
+	// Title is required.
+	Title string `json:"title"`
+	// Navigate is required and MUST be an absolute https URL. It's opened when
+	// the notification is activated.
+	Navigate  string    `json:"navigate"`
+	Language  string    `json:"lang,omitempty"`
+	Direction Direction `json:"dir,omitempty"`
+	Body      string    `json:"body,omitempty"`
+	Tag       string    `json:"tag,omitempty"`
+	Image     string    `json:"image,omitempty"`
+	Icon      string    `json:"icon,omitempty"`
+	Badge     string    `json:"badge,omitempty"`
+	Vibrate   []int     `json:"vibrate,omitempty"`
+	// Timestamp is the time of the notification in milliseconds since the Unix
+	// epoch.
 	Timestamp          uint64                              `json:"timestamp,omitempty"`
 	Renotify           *bool                               `json:"renotify,omitempty"`
 	Silent             *bool                               `json:"silent,omitempty"`
 	RequireInteraction *bool                               `json:"requireInteraction,omitempty"`
 	Data               any                                 `json:"data,omitempty"`
 	Actions            []DeclerativePushNotificationAction `json:"actions,omitempty"`
+
+	// Extra holds unknown members.
+	Extra map[string]json.RawMessage `json:"-"`
 }
 
+// DeclerativePushNotificationAction is an action of a
+// [DeclerativePushNotification].
 // SEE: https://pr-preview.s3.amazonaws.com/w3c/push-api/pull/385.html#declarative-push-message
 type DeclerativePushNotificationAction struct {
-	Action   string `json:"action"`
-	Title    string `json:"title"`
+	// Action is a required identifier of the action.
+	Action string `json:"action"`
+	// Title is required.
+	Title string `json:"title"`
+	// Navigate is required and MUST be an absolute https URL. It's opened when
+	// the action is activated.
 	Navigate string `json:"navigate"`
 	Icon     string `json:"icon,omitempty"`
+
+	// Extra holds unknown members.
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (m DeclerativePushMessage) MarshalJSON() ([]byte, error) {
+	type message DeclerativePushMessage
+	return marshalWithExtra(message(m), m.Extra)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (m *DeclerativePushMessage) UnmarshalJSON(data []byte) error {
+	type message DeclerativePushMessage
+	return unmarshalWithExtra(data, (*message)(m), &m.Extra)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (n DeclerativePushNotification) MarshalJSON() ([]byte, error) {
+	type notification DeclerativePushNotification
+	return marshalWithExtra(notification(n), n.Extra)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (n *DeclerativePushNotification) UnmarshalJSON(data []byte) error {
+	type notification DeclerativePushNotification
+	return unmarshalWithExtra(data, (*notification)(n), &n.Extra)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (a DeclerativePushNotificationAction) MarshalJSON() ([]byte, error) {
+	type action DeclerativePushNotificationAction
+	return marshalWithExtra(action(a), a.Extra)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (a *DeclerativePushNotificationAction) UnmarshalJSON(data []byte) error {
+	type action DeclerativePushNotificationAction
+	return unmarshalWithExtra(data, (*action)(a), &a.Extra)
+}
+
+// marshalWithExtra marshals v, adding the members in extra that are not
+// already set.
+func marshalWithExtra(v any, extra map[string]json.RawMessage) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return data, err
+	}
+
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, err
+	}
+
+	for name, value := range extra {
+		if _, ok := members[name]; !ok {
+			members[name] = value
+		}
+	}
+
+	return json.Marshal(members)
+}
+
+// unmarshalWithExtra unmarshals data into v, keeping members not known by v
+// in extra. Type errors of nested members hold the full path to the member,
+// such as "actions[0].title".
+func unmarshalWithExtra(data []byte, v any, extra *map[string]json.RawMessage) error {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(data, &members); err != nil {
+		return err
+	}
+
+	value := reflect.ValueOf(v).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name, _, _ := strings.Cut(value.Type().Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		member, ok := members[name]
+		if !ok {
+			continue
+		}
+		delete(members, name)
+
+		if err := unmarshalMember(name, member, value.Field(i)); err != nil {
+			return err
+		}
+	}
+
+	if len(members) == 0 {
+		*extra = nil
+	} else {
+		*extra = members
+	}
+
+	return nil
+}
+
+// unmarshalMember unmarshals a member named name into field. Slices of
+// structs are unmarshalled element by element to be able to report the index
+// of invalid elements.
+func unmarshalMember(name string, data json.RawMessage, field reflect.Value) error {
+	if field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct && string(data) != "null" {
+		var elements []json.RawMessage
+		if err := json.Unmarshal(data, &elements); err != nil {
+			return prefixTypeError(name, err)
+		}
+
+		slice := reflect.MakeSlice(field.Type(), len(elements), len(elements))
+		for i, element := range elements {
+			if err := unmarshalMember(fmt.Sprintf("%s[%d]", name, i), element, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+
+		return nil
+	}
+
+	if err := json.Unmarshal(data, field.Addr().Interface()); err != nil {
+		return prefixTypeError(name, err)
+	}
+
+	return nil
+}
+
+// prefixTypeError prefixes the field of a [json.UnmarshalTypeError] with name.
+func prefixTypeError(name string, err error) error {
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &typeError) {
+		if typeError.Field == "" {
+			typeError.Field = name
+		} else {
+			typeError.Field = name + "." + typeError.Field
+		}
+	}
+
+	return err
+}
+
+// MaxDeclarativePushNotificationActions is the maximum number of actions
+// supported in a notification, mirroring the Notification.maxActions of
+// Chromium-based browsers.
+// SEE: https://developer.mozilla.org/en-US/docs/Web/API/Notification/maxActions_static
+const MaxDeclarativePushNotificationActions = 2
+
+// ErrNotDeclarative is returned by [ParseDeclarativePushMessage] when the
+// message is not a declarative push message, meaning it is an opaque message
+// to be handled by the application.
+var ErrNotDeclarative = errors.New("not a declarative push message")
+
+// ValidationError describes an invalid member of a declarative push message.
+type ValidationError struct {
+	// Field is the path to the invalid member, such as
+	// "notification.actions[0].navigate".
+	Field   string
+	Message string
+}
+
+// Error implements error.
+func (e *ValidationError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationErrors holds all validation errors of a declarative push message.
+type ValidationErrors []*ValidationError
+
+// Error implements error.
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return "invalid declarative push message: " + strings.Join(messages, "; ")
+}
+
+// ParseDeclarativePushMessage parses and validates a declarative push message.
+// Returns [ErrNotDeclarative] if the content is not a JSON object with a
+// "web_push" member, in which case the message is opaque. Returns
+// [ValidationErrors] if the message is an invalid declarative push message.
+// SEE: https://pr-preview.s3.amazonaws.com/w3c/push-api/pull/385.html#parse-a-declarative-push-message
+func ParseDeclarativePushMessage(content []byte) (*DeclerativePushMessage, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(content, &members); err != nil {
+		return nil, ErrNotDeclarative
+	}
+
+	if _, ok := members["web_push"]; !ok {
+		return nil, ErrNotDeclarative
+	}
+
+	var message DeclerativePushMessage
+	if err := json.Unmarshal(content, &message); err != nil {
+		var typeError *json.UnmarshalTypeError
+		if errors.As(err, &typeError) {
+			return nil, ValidationErrors{{Field: typeError.Field, Message: "expected " + typeError.Type.String()}}
+		}
+
+		return nil, err
+	}
+
+	if err := message.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// Validate validates the message.
+// Returns [ValidationErrors] if the message is invalid.
+func (m *DeclerativePushMessage) Validate() error {
+	var errs ValidationErrors
+
+	if m.WebPush != 8030 {
+		errs = append(errs, &ValidationError{Field: "web_push", Message: "must be 8030"})
+	}
+
+	n := &m.Notification
+
+	if n.Title == "" {
+		errs = append(errs, &ValidationError{Field: "notification.title", Message: "is required"})
+	}
+
+	if m.Navigate != "" {
+		if err := validateNavigate(m.Navigate); err != "" {
+			errs = append(errs, &ValidationError{Field: "navigate", Message: err})
+		}
+	}
+
+	if err := validateNavigate(n.Navigate); err != "" {
+		errs = append(errs, &ValidationError{Field: "notification.navigate", Message: err})
+	}
+
+	switch n.Direction {
+	case "", DirectionAuto, DirectionLeftToRight, DirectionRightToLeft:
+	default:
+		errs = append(errs, &ValidationError{Field: "notification.dir", Message: `must be one of "auto", "ltr" or "rtl"`})
+	}
+
+	// SEE: https://notifications.spec.whatwg.org/#create-a-notification
+	if n.Silent != nil && *n.Silent && n.Vibrate != nil {
+		errs = append(errs, &ValidationError{Field: "notification.vibrate", Message: "must not be set for silent notifications"})
+	}
+
+	if n.Renotify != nil && *n.Renotify && n.Tag == "" {
+		errs = append(errs, &ValidationError{Field: "notification.renotify", Message: "requires a tag"})
+	}
+
+	if len(n.Actions) > MaxDeclarativePushNotificationActions {
+		errs = append(errs, &ValidationError{
+			Field:   "notification.actions",
+			Message: fmt.Sprintf("must not hold more than %d actions", MaxDeclarativePushNotificationActions),
+		})
+	}
+
+	for i, action := range n.Actions {
+		field := fmt.Sprintf("notification.actions[%d]", i)
+
+		if action.Action == "" {
+			errs = append(errs, &ValidationError{Field: field + ".action", Message: "is required"})
+		}
+
+		if action.Title == "" {
+			errs = append(errs, &ValidationError{Field: field + ".title", Message: "is required"})
+		}
+
+		if err := validateNavigate(action.Navigate); err != "" {
+			errs = append(errs, &ValidationError{Field: field + ".navigate", Message: err})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// validateNavigate returns a description of why a navigation URL is invalid,
+// or an empty string if it is valid.
+func validateNavigate(navigate string) string {
+	if navigate == "" {
+		return "is required"
+	}
+
+	u, err := url.Parse(navigate)
+	if err != nil {
+		return "must be a valid URL"
+	}
+
+	if !u.IsAbs() || u.Host == "" {
+		return "must be an absolute URL"
+	}
+
+	if u.Scheme != "https" {
+		return "must be a https URL"
+	}
+
+	return ""
 }
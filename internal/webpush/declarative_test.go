@@ -0,0 +1,188 @@
+package webpush
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDeclarativePushMessage(t *testing.T) {
+	testCases := []struct {
+		Name           string
+		Content        string
+		NotDeclarative bool
+		ExpectedFields []string
+	}{
+		{
+			Name:    "Minimal",
+			Content: `{"web_push":8030,"notification":{"title":"Hello, World!","navigate":"https://example.com"}}`,
+		},
+		{
+			Name:    "Actions",
+			Content: `{"web_push":8030,"notification":{"title":"Hello, World!","navigate":"https://example.com","actions":[{"action":"open","title":"Open","navigate":"https://example.com/open"}]},"mutable":true}`,
+		},
+		{
+			Name:           "Opaque text",
+			Content:        `Hello, World!`,
+			NotDeclarative: true,
+		},
+		{
+			Name:           "Opaque JSON",
+			Content:        `{"title":"Hello, World!"}`,
+			NotDeclarative: true,
+		},
+		{
+			Name:           "Wrong web_push",
+			Content:        `{"web_push":8291,"notification":{"title":"Hello, World!","navigate":"https://example.com"}}`,
+			ExpectedFields: []string{"web_push"},
+		},
+		{
+			Name:           "Missing notification",
+			Content:        `{"web_push":8030}`,
+			ExpectedFields: []string{"notification.title", "notification.navigate"},
+		},
+		{
+			Name:           "Relative navigate",
+			Content:        `{"web_push":8030,"notification":{"title":"Hello, World!","navigate":"/inbox"}}`,
+			ExpectedFields: []string{"notification.navigate"},
+		},
+		{
+			Name:           "Insecure navigate",
+			Content:        `{"web_push":8030,"notification":{"title":"Hello, World!","navigate":"http://example.com"}}`,
+			ExpectedFields: []string{"notification.navigate"},
+		},
+		{
+			Name:           "Invalid type",
+			Content:        `{"web_push":8030,"notification":{"title":1,"navigate":"https://example.com"}}`,
+			ExpectedFields: []string{"notification.title"},
+		},
+		{
+			Name:           "Invalid actions",
+			Content:        `{"web_push":8030,"notification":{"title":"Hello, World!","navigate":"https://example.com","actions":[{"title":"Open","navigate":"https://example.com"},{"action":"a","title":"A","navigate":"https://example.com"},{"action":"b","title":"B","navigate":"ftp://example.com"}]}}`,
+			ExpectedFields: []string{"notification.actions", "notification.actions[0].action", "notification.actions[2].navigate"},
+		},
+		{
+			Name:           "Silent vibration",
+			Content:        `{"web_push":8030,"notification":{"title":"Hello, World!","navigate":"https://example.com","silent":true,"vibrate":[200]}}`,
+			ExpectedFields: []string{"notification.vibrate"},
+		},
+		{
+			Name:           "Renotify without tag",
+			Content:        `{"web_push":8030,"notification":{"title":"Hello, World!","navigate":"https://example.com","renotify":true}}`,
+			ExpectedFields: []string{"notification.renotify"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			message, err := ParseDeclarativePushMessage([]byte(testCase.Content))
+			if testCase.NotDeclarative {
+				assert.ErrorIs(t, err, ErrNotDeclarative)
+				return
+			}
+
+			if testCase.ExpectedFields == nil {
+				require.NoError(t, err)
+				assert.Equal(t, 8030, message.WebPush)
+				return
+			}
+
+			var validationErrors ValidationErrors
+			require.ErrorAs(t, err, &validationErrors)
+
+			fields := make([]string, len(validationErrors))
+			for i, err := range validationErrors {
+				fields[i] = err.Field
+			}
+			assert.Equal(t, testCase.ExpectedFields, fields)
+		})
+	}
+}
+
+func TestDeclarativePushMessageRoundtrip(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		Content string
+	}{
+		{
+			Name:    "Minimal",
+			Content: `{"web_push":8030,"notification":{"title":"Hello, World!","navigate":"https://example.com"}}`,
+		},
+		{
+			Name: "Spec example",
+			Content: `{
+				"web_push": 8030,
+				"notification": {
+					"title": "Ally's new album is out!",
+					"lang": "en-US",
+					"dir": "ltr",
+					"body": "Listen to it now",
+					"navigate": "https://example.com/albums/ally",
+					"silent": false,
+					"actions": [
+						{"action": "listen", "title": "Listen", "navigate": "https://example.com/albums/ally/play"}
+					]
+				},
+				"app_badge": 12,
+				"mutable": true
+			}`,
+		},
+		{
+			Name:    "Cleared app badge",
+			Content: `{"web_push":8030,"notification":{"title":"Hello, World!","navigate":"https://example.com"},"app_badge":0}`,
+		},
+		{
+			Name:    "Top-level navigate",
+			Content: `{"web_push":8030,"navigate":"https://example.com","notification":{"title":"Hello, World!","navigate":"https://example.com/inbox"}}`,
+		},
+		{
+			Name: "Unknown members",
+			Content: `{
+				"web_push": 8030,
+				"future": {"a": 1},
+				"notification": {
+					"title": "Hello, World!",
+					"navigate": "https://example.com",
+					"future": [1, 2],
+					"actions": [
+						{"action": "open", "title": "Open", "navigate": "https://example.com", "future": "value"}
+					]
+				}
+			}`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			message, err := ParseDeclarativePushMessage([]byte(testCase.Content))
+			require.NoError(t, err)
+
+			content, err := json.Marshal(message)
+			require.NoError(t, err)
+
+			assert.JSONEq(t, testCase.Content, string(content))
+		})
+	}
+}
+
+func TestDeclarativePushMessageDirection(t *testing.T) {
+	message := DeclerativePushMessage{
+		WebPush: 8030,
+		Notification: DeclerativePushNotification{
+			Title:     "Hello, World!",
+			Navigate:  "https://example.com",
+			Direction: DirectionRightToLeft,
+		},
+	}
+
+	content, err := json.Marshal(&message)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"web_push":8030,"notification":{"title":"Hello, World!","navigate":"https://example.com","dir":"rtl"}}`, string(content))
+
+	_, err = ParseDeclarativePushMessage([]byte(`{"web_push":8030,"notification":{"title":"Hello, World!","navigate":"https://example.com","dir":"up"}}`))
+	var validationErrors ValidationErrors
+	require.ErrorAs(t, err, &validationErrors)
+	assert.Equal(t, "notification.dir", validationErrors[0].Field)
+}
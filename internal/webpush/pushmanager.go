@@ -1,14 +1,15 @@
 package webpush
 
 import (
+	"context"
 	"crypto/ecdh"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"log/slog"
 	"sync"
 	"time"
-
-	"github.com/AlexGustafsson/web-push-poc/internal/aes128gcm"
 )
 
 // Subscription is a Web Push subscription received from a Push Service via a
@@ -68,19 +69,142 @@ func (s *SubscriptionKeys) AuthenticationSecret() ([]byte, error) {
 // SEE: VAPID - https://datatracker.ietf.org/doc/html/rfc8292#section-3.2.
 // SEE: Message Encryption for Web Push - https://www.rfc-editor.org/rfc/rfc8291.html
 type PushManager struct {
+	// RenewBefore is how long before a subscription expires that it's renewed
+	// by [PushManager.Run]. Defaults to one hour.
+	RenewBefore time.Duration
+
 	subscriber Subscriber
+	store      SubscriptionStore
+
+	mutex                sync.Mutex
+	onSubscriptionChange func(SubscriptionChange)
+
+	listenersMutex sync.RWMutex
+	listeners      map[*messageListener]struct{}
+}
+
+// PushEvent is a decrypted push message.
+// SEE: https://developer.mozilla.org/en-US/docs/Web/API/PushEvent.
+type PushEvent struct {
+	SubscriptionID string
+	ContentType    string
+	Content        []byte
+	// Notification is set if the message is a declarative push message.
+	Notification *DeclerativePushMessage
+}
 
-	mutex         sync.RWMutex
-	subscriptions map[string]*Subscription
+type messageListener struct {
+	ctx    context.Context
+	events chan PushEvent
+}
+
+// SubscriptionChange is emitted when a subscription is replaced by a new one.
+// The application is expected to forward the new subscription to its
+// application server.
+// SEE: https://developer.mozilla.org/en-US/docs/Web/API/ServiceWorkerGlobalScope/pushsubscriptionchange_event.
+type SubscriptionChange struct {
+	Old *Subscription
+	New *Subscription
 }
 
 // NewPushManager creates a new [PushManager] using the given [Subscriber] to
-// handle subscriptions.
-func NewPushManager(subscriber Subscriber) *PushManager {
-	return &PushManager{
-		subscriber:    subscriber,
-		subscriptions: make(map[string]*Subscription),
+// handle subscriptions and the given [SubscriptionStore] to keep them.
+func NewPushManager(subscriber Subscriber, store SubscriptionStore) *PushManager {
+	p := &PushManager{
+		RenewBefore: 1 * time.Hour,
+
+		subscriber: subscriber,
+		store:      store,
+
+		listeners: make(map[*messageListener]struct{}),
+	}
+
+	if subscriber, ok := subscriber.(MessageSubscriber); ok {
+		subscriber.OnPushMessage(p.receive)
+	}
+
+	if subscriber, ok := subscriber.(ChangingSubscriber); ok {
+		subscriber.OnEndpointChange(p.changeEndpoint)
+	}
+
+	return p
+}
+
+// Messages returns a channel of decrypted push messages received by the
+// [Subscriber], if it implements [MessageSubscriber]. The channel is closed
+// once the context is cancelled. Until then, the channel must be drained as
+// messages are delivered to all channels before the next message is handled.
+func (p *PushManager) Messages(ctx context.Context) <-chan PushEvent {
+	listener := &messageListener{
+		ctx:    ctx,
+		events: make(chan PushEvent),
+	}
+
+	p.listenersMutex.Lock()
+	p.listeners[listener] = struct{}{}
+	p.listenersMutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		// Waits for any ongoing delivery, which is aborted by the cancelled
+		// context
+		p.listenersMutex.Lock()
+		delete(p.listeners, listener)
+		p.listenersMutex.Unlock()
+
+		close(listener.events)
+	}()
+
+	return listener.events
+}
+
+// receive decrypts a message received by the subscriber and delivers it to
+// all listeners.
+func (p *PushManager) receive(message ReceivedMessage) error {
+	content, err := p.HandleMessage(message.SubscriptionID, message.Content)
+	if err != nil {
+		return err
+	}
+
+	event := PushEvent{
+		SubscriptionID: message.SubscriptionID,
+		ContentType:    message.ContentType,
+		Content:        content,
 	}
+
+	// Invalid declarative push messages are delivered as opaque messages
+	// SEE: https://pr-preview.s3.amazonaws.com/w3c/push-api/pull/385.html#receiving-a-push-message
+	notification, err := ParseDeclarativePushMessage(content)
+	if err == nil {
+		event.Notification = notification
+	} else if !errors.Is(err, ErrNotDeclarative) {
+		slog.Debug("Got invalid declarative push message", slog.String("subscriptionId", message.SubscriptionID), slog.Any("error", err))
+	}
+
+	p.listenersMutex.RLock()
+	defer p.listenersMutex.RUnlock()
+
+	if len(p.listeners) == 0 {
+		return ErrNoListeners
+	}
+
+	for listener := range p.listeners {
+		select {
+		case listener.events <- event:
+		case <-listener.ctx.Done():
+		}
+	}
+
+	return nil
+}
+
+// OnSubscriptionChange sets a handler to be invoked each time a subscription
+// is renewed or its endpoint is changed by the [Subscriber].
+func (p *PushManager) OnSubscriptionChange(handler func(SubscriptionChange)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.onSubscriptionChange = handler
 }
 
 func (p *PushManager) Subscribe(applicationServerPublicKey *ecdh.PublicKey) (*Subscription, error) {
@@ -91,20 +215,33 @@ func (p *PushManager) Subscribe(applicationServerPublicKey *ecdh.PublicKey) (*Su
 
 	p256dh := base64.RawURLEncoding.EncodeToString(userAgentPrivateKey.PublicKey().Bytes())
 
-	subscriptionID, endpoint, err := p.subscriber.Subscribe(userAgentPrivateKey, applicationServerPublicKey)
-	if err != nil {
+	authenticationSecret := make([]byte, 16)
+	if _, err := rand.Read(authenticationSecret); err != nil {
 		return nil, err
 	}
 
-	authenticationSecret := make([]byte, 16)
-	if _, err := rand.Read(authenticationSecret); err != nil {
+	var subscriptionID, endpoint string
+	if subscriber, ok := p.subscriber.(AuthenticatingSubscriber); ok {
+		subscriptionID, endpoint, err = subscriber.SubscribeWithAuthenticationSecret(userAgentPrivateKey, applicationServerPublicKey, authenticationSecret)
+	} else {
+		subscriptionID, endpoint, err = p.subscriber.Subscribe(userAgentPrivateKey, applicationServerPublicKey)
+	}
+	if err != nil {
 		return nil, err
 	}
 
+	var expirationTime *time.Time
+	if subscriber, ok := p.subscriber.(ExpiringSubscriber); ok {
+		expirationTime, err = subscriber.ExpirationTime(subscriptionID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	subscription := &Subscription{
 		ID:             subscriptionID,
 		Endpoint:       endpoint,
-		ExpirationTime: nil,
+		ExpirationTime: expirationTime,
 		Keys: SubscriptionKeys{
 			Auth:   base64.RawURLEncoding.EncodeToString(authenticationSecret),
 			P256DH: p256dh,
@@ -114,48 +251,145 @@ func (p *PushManager) Subscribe(applicationServerPublicKey *ecdh.PublicKey) (*Su
 		userAgentPrivateKey:        userAgentPrivateKey,
 	}
 
-	p.mutex.Lock()
-	p.subscriptions[subscriptionID] = subscription
-	p.mutex.Unlock()
+	if err := p.store.Put(subscription); err != nil {
+		return nil, err
+	}
 
 	return subscription, nil
 }
 
-// HandleMessage handles a message for a subscription.
-// Returns the message's content.
-func (p *PushManager) HandleMessage(subscriptionID string, message []byte) ([]byte, error) {
-	p.mutex.RLock()
-	defer p.mutex.RUnlock()
+// GetSubscription returns a subscription.
+// Returns [ErrSubscriptionNotFound] if the subscription does not exist.
+func (p *PushManager) GetSubscription(subscriptionID string) (*Subscription, error) {
+	return p.store.Get(subscriptionID)
+}
+
+// Subscriptions returns all subscriptions.
+func (p *PushManager) Subscriptions() ([]*Subscription, error) {
+	return p.store.List()
+}
 
-	subscription, ok := p.subscriptions[subscriptionID]
-	if !ok {
-		return nil, fmt.Errorf("unknown subscription")
+// Unsubscribe tears down a subscription with the push service and removes it.
+// Returns [ErrSubscriptionNotFound] if the subscription does not exist.
+func (p *PushManager) Unsubscribe(subscriptionID string) error {
+	if _, err := p.store.Get(subscriptionID); err != nil {
+		return err
 	}
 
-	authenticationSecret, err := subscription.Keys.AuthenticationSecret()
+	if err := p.subscriber.Unsubscribe(subscriptionID); err != nil {
+		return err
+	}
+
+	return p.store.Delete(subscriptionID)
+}
+
+// Run renews subscriptions before they expire, until the context is
+// cancelled. Each renewed subscription is reported to the handler set using
+// [PushManager.OnSubscriptionChange].
+func (p *PushManager) Run(ctx context.Context) error {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		p.renewExpiring(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// renewExpiring renews all subscriptions expiring within
+// [PushManager.RenewBefore] of now.
+func (p *PushManager) renewExpiring(now time.Time) {
+	subscriptions, err := p.store.List()
 	if err != nil {
-		return nil, err
+		slog.Error("Failed to list subscriptions", slog.Any("error", err))
+		return
 	}
 
-	var header aes128gcm.Header
-	if err := header.UnmarshalBinary(message); err != nil {
+	for _, subscription := range subscriptions {
+		if subscription.ExpirationTime == nil || subscription.ExpirationTime.Sub(now) > p.RenewBefore {
+			continue
+		}
+
+		if _, err := p.renew(subscription); err != nil {
+			slog.Error("Failed to renew subscription", slog.String("subscriptionId", subscription.ID), slog.Any("error", err))
+		}
+	}
+}
+
+// renew replaces a subscription with a new one for the same application
+// server. The old subscription is removed once the new one is created.
+func (p *PushManager) renew(old *Subscription) (*Subscription, error) {
+	subscription, err := p.Subscribe(old.applicationServerPublicKey)
+	if err != nil {
 		return nil, err
 	}
 
-	// Ephemeral sender key
-	senderPublicKey, err := ecdh.P256().NewPublicKey(header.KeyID)
+	if err := p.Unsubscribe(old.ID); err != nil {
+		// The old subscription will expire regardless, don't fail the renewal
+		slog.Warn("Failed to unsubscribe renewed subscription", slog.String("subscriptionId", old.ID), slog.Any("error", err))
+		p.store.Delete(old.ID)
+	}
+
+	p.mutex.Lock()
+	handler := p.onSubscriptionChange
+	p.mutex.Unlock()
+
+	if handler != nil {
+		handler(SubscriptionChange{Old: old, New: subscription})
+	}
+
+	return subscription, nil
+}
+
+// changeEndpoint updates the endpoint of a subscription changed by the
+// subscriber.
+func (p *PushManager) changeEndpoint(subscriptionID string, endpoint string) {
+	old, err := p.store.Get(subscriptionID)
+	if err != nil {
+		slog.Error("Failed to get changed subscription", slog.String("subscriptionId", subscriptionID), slog.Any("error", err))
+		return
+	}
+
+	subscription := *old
+	subscription.Endpoint = endpoint
+
+	if err := p.store.Put(&subscription); err != nil {
+		slog.Error("Failed to store changed subscription", slog.String("subscriptionId", subscriptionID), slog.Any("error", err))
+		return
+	}
+
+	p.mutex.Lock()
+	handler := p.onSubscriptionChange
+	p.mutex.Unlock()
+
+	if handler != nil {
+		handler(SubscriptionChange{Old: old, New: &subscription})
+	}
+}
+
+// HandleMessage handles a message for a subscription.
+// Returns the message's content. Returns [ErrDecryptionFailed] if the message
+// could not be decrypted.
+func (p *PushManager) HandleMessage(subscriptionID string, message []byte) ([]byte, error) {
+	subscription, err := p.store.Get(subscriptionID)
 	if err != nil {
 		return nil, err
 	}
 
-	ikm, err := DeriveInputKeyingMaterial(
-		subscription.userAgentPrivateKey, senderPublicKey,
-		subscription.userAgentPrivateKey.PublicKey(), subscription.applicationServerPublicKey,
-		authenticationSecret,
-	)
+	authenticationSecret, err := subscription.Keys.AuthenticationSecret()
 	if err != nil {
 		return nil, err
 	}
 
-	return aes128gcm.Decrypt(message, ikm)
+	content, err := DecryptMessage(subscription.userAgentPrivateKey, authenticationSecret, message)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecryptionFailed, err)
+	}
+
+	return content, nil
 }
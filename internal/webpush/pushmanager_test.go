@@ -1,11 +1,50 @@
 package webpush
 
 import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// fakeSubscriber is a [Subscriber] keeping track of active subscriptions.
+type fakeSubscriber struct {
+	next          int
+	subscriptions map[string]struct{}
+}
+
+func newFakeSubscriber() *fakeSubscriber {
+	return &fakeSubscriber{
+		subscriptions: make(map[string]struct{}),
+	}
+}
+
+// Subscribe implements Subscriber.
+func (s *fakeSubscriber) Subscribe(*ecdh.PrivateKey, *ecdh.PublicKey) (string, string, error) {
+	s.next++
+	id := fmt.Sprintf("%d", s.next)
+	s.subscriptions[id] = struct{}{}
+	return id, "https://example.com/push/" + id, nil
+}
+
+// Unsubscribe implements Subscriber.
+func (s *fakeSubscriber) Unsubscribe(subscriptionID string) error {
+	if _, ok := s.subscriptions[subscriptionID]; !ok {
+		return fmt.Errorf("unknown subscription")
+	}
+
+	delete(s.subscriptions, subscriptionID)
+	return nil
+}
+
 func TestSubscriptionKeysPublicKey(t *testing.T) {
 	testCases := []struct {
 		Name   string
@@ -35,3 +74,205 @@ func TestSubscriptionKeysPublicKey(t *testing.T) {
 		})
 	}
 }
+
+func TestPushManagerUnsubscribe(t *testing.T) {
+	applicationServerPrivateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	subscriber := newFakeSubscriber()
+	pushManager := NewPushManager(subscriber, NewMemorySubscriptionStore())
+
+	subscription, err := pushManager.Subscribe(applicationServerPrivateKey.PublicKey())
+	require.NoError(t, err)
+
+	actualSubscription, err := pushManager.GetSubscription(subscription.ID)
+	require.NoError(t, err)
+	assert.Equal(t, subscription, actualSubscription)
+
+	subscriptions, err := pushManager.Subscriptions()
+	require.NoError(t, err)
+	assert.Equal(t, []*Subscription{subscription}, subscriptions)
+
+	require.NoError(t, pushManager.Unsubscribe(subscription.ID))
+	assert.Empty(t, subscriber.subscriptions)
+
+	_, err = pushManager.GetSubscription(subscription.ID)
+	assert.ErrorIs(t, err, ErrSubscriptionNotFound)
+
+	err = pushManager.Unsubscribe(subscription.ID)
+	assert.ErrorIs(t, err, ErrSubscriptionNotFound)
+}
+
+func TestPushManagerHandleMessageError(t *testing.T) {
+	applicationServerPrivateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	pushManager := NewPushManager(newFakeSubscriber(), NewMemorySubscriptionStore())
+
+	subscription, err := pushManager.Subscribe(applicationServerPrivateKey.PublicKey())
+	require.NoError(t, err)
+
+	_, err = pushManager.HandleMessage(subscription.ID, []byte("Hello, World!"))
+	assert.ErrorIs(t, err, ErrDecryptionFailed)
+
+	_, err = pushManager.HandleMessage("unknown", []byte("Hello, World!"))
+	assert.ErrorIs(t, err, ErrSubscriptionNotFound)
+}
+
+// expiringSubscriber is a [fakeSubscriber] whose subscriptions expire after a
+// fixed time.
+type expiringSubscriber struct {
+	*fakeSubscriber
+	expirationTime time.Time
+}
+
+// ExpirationTime implements ExpiringSubscriber.
+func (s *expiringSubscriber) ExpirationTime(string) (*time.Time, error) {
+	expirationTime := s.expirationTime
+	return &expirationTime, nil
+}
+
+func TestPushManagerRenewExpiring(t *testing.T) {
+	now := time.Now()
+
+	applicationServerPrivateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	subscriber := &expiringSubscriber{
+		fakeSubscriber: newFakeSubscriber(),
+		expirationTime: now.Add(2 * time.Hour),
+	}
+	pushManager := NewPushManager(subscriber, NewMemorySubscriptionStore())
+
+	var changes []SubscriptionChange
+	pushManager.OnSubscriptionChange(func(change SubscriptionChange) {
+		changes = append(changes, change)
+	})
+
+	subscription, err := pushManager.Subscribe(applicationServerPrivateKey.PublicKey())
+	require.NoError(t, err)
+	require.NotNil(t, subscription.ExpirationTime)
+	assert.Equal(t, subscriber.expirationTime, *subscription.ExpirationTime)
+
+	// Not yet within the renewal window
+	pushManager.renewExpiring(now)
+	assert.Empty(t, changes)
+
+	subscriber.expirationTime = now.Add(4 * time.Hour)
+	pushManager.renewExpiring(now.Add(90 * time.Minute))
+	require.Len(t, changes, 1)
+	assert.Equal(t, subscription, changes[0].Old)
+	assert.NotEqual(t, subscription.ID, changes[0].New.ID)
+	assert.Equal(t, subscriber.expirationTime, *changes[0].New.ExpirationTime)
+
+	// The old subscription is removed
+	subscriptions, err := pushManager.Subscriptions()
+	require.NoError(t, err)
+	assert.Equal(t, []*Subscription{changes[0].New}, subscriptions)
+	assert.Len(t, subscriber.subscriptions, 1)
+}
+
+// authenticatingSubscriber is a [fakeSubscriber] recording the authentication
+// secret of subscriptions.
+type authenticatingSubscriber struct {
+	*fakeSubscriber
+	authenticationSecret []byte
+}
+
+// SubscribeWithAuthenticationSecret implements AuthenticatingSubscriber.
+func (s *authenticatingSubscriber) SubscribeWithAuthenticationSecret(userAgentPrivateKey *ecdh.PrivateKey, applicationServerPublicKey *ecdh.PublicKey, authenticationSecret []byte) (string, string, error) {
+	s.authenticationSecret = authenticationSecret
+	return s.Subscribe(userAgentPrivateKey, applicationServerPublicKey)
+}
+
+func TestPushManagerSubscribeWithAuthenticationSecret(t *testing.T) {
+	applicationServerPrivateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	subscriber := &authenticatingSubscriber{fakeSubscriber: newFakeSubscriber()}
+	pushManager := NewPushManager(subscriber, NewMemorySubscriptionStore())
+
+	subscription, err := pushManager.Subscribe(applicationServerPrivateKey.PublicKey())
+	require.NoError(t, err)
+
+	authenticationSecret, err := subscription.Keys.AuthenticationSecret()
+	require.NoError(t, err)
+	assert.Equal(t, authenticationSecret, subscriber.authenticationSecret)
+}
+
+// messageSubscriber is a [fakeSubscriber] receiving messages itself.
+type messageSubscriber struct {
+	*fakeSubscriber
+	onPushMessage func(ReceivedMessage) error
+}
+
+// OnPushMessage implements MessageSubscriber.
+func (s *messageSubscriber) OnPushMessage(handler func(ReceivedMessage) error) {
+	s.onPushMessage = handler
+}
+
+func TestPushManagerMessages(t *testing.T) {
+	content := []byte(`{"web_push":8030,"notification":{"title":"Hello, World!","navigate":"https://example.com"}}`)
+
+	applicationServer, err := NewApplicationServer()
+	require.NoError(t, err)
+
+	subscriber := &messageSubscriber{fakeSubscriber: newFakeSubscriber()}
+	pushManager := NewPushManager(subscriber, NewMemorySubscriptionStore())
+
+	subscription, err := pushManager.Subscribe(applicationServer.PublicECDH())
+	require.NoError(t, err)
+
+	// The server acts as the push service, passing messages to the subscriber
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ciphertext, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		err = subscriber.onPushMessage(ReceivedMessage{
+			SubscriptionID: subscription.ID,
+			ContentType:    r.Header.Get("Content-Type"),
+			Content:        ciphertext,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	subscription.Endpoint = server.URL
+
+	target, err := subscription.PushTarget()
+	require.NoError(t, err)
+
+	// Messages without listeners are not handled
+	err = applicationServer.Push(context.TODO(), target, content, nil)
+	require.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages := pushManager.Messages(ctx)
+
+	go func() {
+		err := applicationServer.Push(context.TODO(), target, content, &PushOptions{ContentType: "application/notification+json"})
+		assert.NoError(t, err)
+	}()
+
+	var event PushEvent
+	select {
+	case event = <-messages:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for message")
+	}
+	assert.Equal(t, subscription.ID, event.SubscriptionID)
+	assert.Equal(t, "application/notification+json", event.ContentType)
+	assert.Equal(t, content, event.Content)
+	require.NotNil(t, event.Notification)
+	assert.Equal(t, "Hello, World!", event.Notification.Notification.Title)
+
+	cancel()
+	_, ok := <-messages
+	assert.False(t, ok)
+}
@@ -1,16 +1,46 @@
 package webpush
 
 import (
+	"errors"
 	"io"
+	"math"
 	"net/http"
 	"strconv"
+	"time"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/vapid"
 )
 
+// DefaultMaxMessageSize is the default maximum size of a push message's body.
+// A push service MUST support messages of up to 4096 octets.
+// SEE: https://www.rfc-editor.org/rfc/rfc8291.html#section-4
+const DefaultMaxMessageSize = 4096
+
 // PushServer is (intended) to serve spec-compliant APIs for Web Push
 // functionality.
 // TODO: Only implement the PUSH endpoint in this package?
 // subscription/unsubscription is not mandated by the RFC?
 type PushServer struct {
+	// MaxMessageSize is the maximum size of a push message's body, in bytes.
+	// Larger messages are rejected with 413 Payload Too Large.
+	// Defaults to [DefaultMaxMessageSize].
+	MaxMessageSize int64
+
+	// ApplicationServerRateLimiter, if set, limits the rate of push messages
+	// per application server, keyed by the Base64 URL-encoded public key in
+	// the VAPID Authorization header. Messages without a valid VAPID header
+	// share the empty key.
+	ApplicationServerRateLimiter *RateLimiter
+
+	// SubscriptionRateLimiter, if set, limits the rate of push messages per
+	// subscription, keyed by the push endpoint's token.
+	SubscriptionRateLimiter *RateLimiter
+
+	// Origin is the origin of push endpoints, such as "https://push.example",
+	// which VAPID tokens must be intended for. Defaults to the origin of each
+	// request, which may differ from the public origin behind a proxy.
+	Origin string
+
 	mux    *http.ServeMux
 	pusher Pusher
 }
@@ -21,6 +51,8 @@ type PushServer struct {
 // interoperable as long as the push endpoint is supported
 func NewPushServer(pusher Pusher) *PushServer {
 	server := &PushServer{
+		MaxMessageSize: DefaultMaxMessageSize,
+
 		mux:    http.NewServeMux(),
 		pusher: pusher,
 	}
@@ -46,6 +78,29 @@ func (s *PushServer) postPush(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Rate limit before doing any more work
+	var applicationServerKey string
+	if s.ApplicationServerRateLimiter != nil {
+		// NOTE: VAPID is not required. Application servers without a valid VAPID
+		// header are limited as one, as anyone could claim any key
+		applicationServerKey = s.verifiedApplicationServerKey(r)
+		if ok, wait := s.ApplicationServerRateLimiter.Allow(applicationServerKey); !ok {
+			writeTooManyRequests(w, wait)
+			return
+		}
+	}
+
+	if s.SubscriptionRateLimiter != nil {
+		if ok, wait := s.SubscriptionRateLimiter.Allow(token); !ok {
+			// Don't count rejected requests against the application server
+			if s.ApplicationServerRateLimiter != nil {
+				s.ApplicationServerRateLimiter.Refund(applicationServerKey)
+			}
+			writeTooManyRequests(w, wait)
+			return
+		}
+	}
+
 	ttlString := r.Header.Get("TTL")
 	if ttlString == "" {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
@@ -66,37 +121,76 @@ func (s *PushServer) postPush(w http.ResponseWriter, r *http.Request) {
 
 	topic := r.Header.Get("Topic")
 
-	contentLengthString := r.Header.Get("Content-Length")
-	if contentLengthString == "" {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
+	maxMessageSize := s.MaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = DefaultMaxMessageSize
 	}
 
-	contentLength, err := strconv.ParseInt(contentLengthString, 10, 32)
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	// A push service MAY place an upper limit on the size of push messages that
+	// it permits, responding with 413 (Payload Too Large) to larger messages.
+	// Fail early if the declared length is already too large. Chunked bodies
+	// have an unknown length (-1) and are limited when read instead
+	// SEE: https://datatracker.ietf.org/doc/html/rfc8030#section-7.2
+	if r.ContentLength > maxMessageSize {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	// TODO: Make max content-type configurable?
-	content := make([]byte, contentLength)
-	_, err = io.ReadFull(r.Body, content)
+	content, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
 	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
+	// Push messages without content carry no encryption, all other messages
+	// MUST use the "aes128gcm" content coding. The legacy "aesgcm" coding of
+	// earlier drafts is not supported.
+	// SEE: https://www.rfc-editor.org/rfc/rfc8291.html#section-4
+	contentEncoding := r.Header.Get("Content-Encoding")
+	if len(content) > 0 {
+		if contentEncoding != "aes128gcm" {
+			http.Error(w, "unsupported content encoding: expected aes128gcm", http.StatusBadRequest)
+			return
+		}
+
+		if err := ValidateMessage(content); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	request := PushRequest{
-		Token:       token,
-		TTL:         int(ttl),
-		Topic:       topic,
-		ContentType: r.Header.Get("Content-Type"),
-		Content:     content,
+		Token:           token,
+		TTL:             int(ttl),
+		Topic:           topic,
+		Urgency:         Urgency(urgency),
+		ContentType:     r.Header.Get("Content-Type"),
+		ContentEncoding: contentEncoding,
+		Content:         content,
 	}
 
 	// TODO: What type of interface do we want for implementers here?
 	// Include actual HTTP request as well, and let the handler write to the body?
-	if err := s.pusher.Push(&request); err != nil {
+	if err := s.pusher.Push(&request); errors.Is(err, ErrSubscriptionNotFound) {
+		// SEE: https://datatracker.ietf.org/doc/html/rfc8030#section-7.3
+		http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+		return
+	} else if errors.Is(err, ErrDecryptionFailed) {
+		// The message is malformed or encrypted using the wrong keys, retrying
+		// won't help
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, ErrDeliveryFailed) {
+		// Let the application server know to retry the push later
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -104,6 +198,40 @@ func (s *PushServer) postPush(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 }
 
+// verifiedApplicationServerKey returns the Base64 URL-encoded public key of
+// the application server identified by the request's VAPID Authorization
+// header, or an empty string if there is no valid header.
+// SEE: https://datatracker.ietf.org/doc/html/rfc8292#section-4.2
+func (s *PushServer) verifiedApplicationServerKey(r *http.Request) string {
+	token, key, err := vapid.ParseAuthorizationHeader(r.Header.Get("Authorization"))
+	if err != nil {
+		return ""
+	}
+
+	origin := s.Origin
+	if origin == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		origin = scheme + "://" + r.Host
+	}
+
+	if err := vapid.VerifyToken(token, key, origin, time.Now()); err != nil {
+		return ""
+	}
+
+	return key
+}
+
+// writeTooManyRequests responds with 429 Too Many Requests, indicating when
+// the client may retry.
+// SEE: https://datatracker.ietf.org/doc/html/rfc6585#section-4
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
 func (s *PushServer) deleteMessage(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
 }
@@ -0,0 +1,317 @@
+package webpush
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AlexGustafsson/web-push-poc/internal/aes128gcm"
+	"github.com/AlexGustafsson/web-push-poc/internal/vapid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type pusherFunc func(request *PushRequest) error
+
+func (f pusherFunc) Push(request *PushRequest) error {
+	return f(request)
+}
+
+func TestPushServerMaxMessageSize(t *testing.T) {
+	testCases := []struct {
+		Name           string
+		MaxMessageSize int64
+		ContentSize    int
+		Chunked        bool
+		ExpectedStatus int
+	}{
+		{
+			Name:           "Default limit",
+			ContentSize:    DefaultMaxMessageSize,
+			ExpectedStatus: http.StatusCreated,
+		},
+		{
+			Name:           "Default limit exceeded",
+			ContentSize:    DefaultMaxMessageSize + 1,
+			ExpectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			Name:           "Chunked",
+			ContentSize:    DefaultMaxMessageSize,
+			Chunked:        true,
+			ExpectedStatus: http.StatusCreated,
+		},
+		{
+			Name:           "Chunked limit exceeded",
+			ContentSize:    DefaultMaxMessageSize + 1,
+			Chunked:        true,
+			ExpectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			Name:           "Custom limit",
+			MaxMessageSize: 8192,
+			ContentSize:    8192,
+			ExpectedStatus: http.StatusCreated,
+		},
+		{
+			Name:           "Custom limit exceeded",
+			MaxMessageSize: 128,
+			ContentSize:    129,
+			Chunked:        true,
+			ExpectedStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			content := newTestMessage(t, testCase.ContentSize)
+
+			var pushed *PushRequest
+			server := NewPushServer(pusherFunc(func(request *PushRequest) error {
+				pushed = request
+				return nil
+			}))
+			if testCase.MaxMessageSize != 0 {
+				server.MaxMessageSize = testCase.MaxMessageSize
+			}
+
+			var body io.Reader = bytes.NewReader(content)
+			if testCase.Chunked {
+				// Hide the length so that the request is sent chunked
+				body = io.MultiReader(body)
+			}
+
+			request := httptest.NewRequest(http.MethodPost, "/push/token", body)
+			request.Header.Set("TTL", "60")
+			request.Header.Set("Content-Encoding", "aes128gcm")
+			if testCase.Chunked {
+				request.ContentLength = -1
+				request.TransferEncoding = []string{"chunked"}
+			}
+
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, request)
+
+			require.Equal(t, testCase.ExpectedStatus, recorder.Code)
+			if testCase.ExpectedStatus == http.StatusCreated {
+				require.NotNil(t, pushed)
+				assert.Equal(t, content, pushed.Content)
+			} else {
+				assert.Nil(t, pushed)
+			}
+		})
+	}
+}
+
+func TestPushServerValidateMessage(t *testing.T) {
+	message := newTestMessage(t, 256)
+
+	// Header with a 3B key id
+	shortKeyID := bytes.Clone(message[:16])
+	shortKeyID = append(shortKeyID, 0x00, 0x00, 0x10, 0x00, 0x03, 0x01, 0x02, 0x03)
+	shortKeyID = append(shortKeyID, message[86:]...)
+
+	// Header with a record size smaller than the body
+	smallRecordSize := bytes.Clone(message)
+	smallRecordSize[16], smallRecordSize[17], smallRecordSize[18], smallRecordSize[19] = 0x00, 0x00, 0x00, 0x20
+
+	testCases := []struct {
+		Name            string
+		ContentEncoding string
+		Content         []byte
+		ExpectedStatus  int
+	}{
+		{
+			Name:            "Valid",
+			ContentEncoding: "aes128gcm",
+			Content:         message,
+			ExpectedStatus:  http.StatusCreated,
+		},
+		{
+			Name:           "No content",
+			ExpectedStatus: http.StatusCreated,
+		},
+		{
+			Name:           "Missing content encoding",
+			Content:        message,
+			ExpectedStatus: http.StatusBadRequest,
+		},
+		{
+			Name:            "Legacy content encoding",
+			ContentEncoding: "aesgcm",
+			Content:         message,
+			ExpectedStatus:  http.StatusBadRequest,
+		},
+		{
+			Name:            "Truncated header",
+			ContentEncoding: "aes128gcm",
+			Content:         message[:20],
+			ExpectedStatus:  http.StatusBadRequest,
+		},
+		{
+			Name:            "Short key id",
+			ContentEncoding: "aes128gcm",
+			Content:         shortKeyID,
+			ExpectedStatus:  http.StatusBadRequest,
+		},
+		{
+			Name:            "Missing record",
+			ContentEncoding: "aes128gcm",
+			Content:         message[:86],
+			ExpectedStatus:  http.StatusBadRequest,
+		},
+		{
+			Name:            "Multiple records",
+			ContentEncoding: "aes128gcm",
+			Content:         smallRecordSize,
+			ExpectedStatus:  http.StatusBadRequest,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			server := NewPushServer(pusherFunc(func(request *PushRequest) error {
+				return nil
+			}))
+
+			request := httptest.NewRequest(http.MethodPost, "/push/token", bytes.NewReader(testCase.Content))
+			request.Header.Set("TTL", "60")
+			if testCase.ContentEncoding != "" {
+				request.Header.Set("Content-Encoding", testCase.ContentEncoding)
+			}
+
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, request)
+
+			assert.Equal(t, testCase.ExpectedStatus, recorder.Code, recorder.Body.String())
+		})
+	}
+}
+
+// newTestMessage returns a valid aes128gcm encoded message of the given size,
+// using a single record.
+func newTestMessage(t *testing.T, size int) []byte {
+	privateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	var ikm [32]byte
+	_, err = rand.Read(ikm[:])
+	require.NoError(t, err)
+
+	var salt [16]byte
+	_, err = rand.Read(salt[:])
+	require.NoError(t, err)
+
+	// 16B salt, 4B record size, 1B key id length, 65B key id, 1B padding
+	// delimiter and 16B authentication tag
+	plaintext := make([]byte, size-16-4-1-65-1-16)
+
+	message, err := aes128gcm.Encrypt(plaintext, ikm[:], salt[:], privateKey.PublicKey().Bytes(), max(size, 4096))
+	require.NoError(t, err)
+	require.Len(t, message, size)
+
+	return message
+}
+
+func TestPushServerPushError(t *testing.T) {
+	testCases := []struct {
+		Name           string
+		Err            error
+		ExpectedStatus int
+	}{
+		{Name: "No error", Err: nil, ExpectedStatus: http.StatusCreated},
+		{Name: "Not found", Err: fmt.Errorf("%w: revoked", ErrSubscriptionNotFound), ExpectedStatus: http.StatusGone},
+		{Name: "Decryption failed", Err: fmt.Errorf("%w: invalid padding", ErrDecryptionFailed), ExpectedStatus: http.StatusBadRequest},
+		{Name: "Delivery failed", Err: fmt.Errorf("%w: timeout", ErrDeliveryFailed), ExpectedStatus: http.StatusServiceUnavailable},
+		{Name: "Other", Err: errors.New("error"), ExpectedStatus: http.StatusInternalServerError},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			server := NewPushServer(pusherFunc(func(request *PushRequest) error {
+				assert.Equal(t, UrgencyHigh, request.Urgency)
+				return testCase.Err
+			}))
+
+			request := httptest.NewRequest(http.MethodPost, "/push/token", nil)
+			request.Header.Set("TTL", "60")
+			request.Header.Set("Urgency", "high")
+
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, request)
+			assert.Equal(t, testCase.ExpectedStatus, recorder.Code)
+		})
+	}
+}
+
+func TestPushServerRateLimit(t *testing.T) {
+	server := NewPushServer(pusherFunc(func(request *PushRequest) error {
+		return nil
+	}))
+	server.ApplicationServerRateLimiter = NewRateLimiter(RateLimit{Rate: 0.5, Burst: 2})
+	server.SubscriptionRateLimiter = NewRateLimiter(RateLimit{Rate: 0.5, Burst: 1})
+
+	// authorization returns a valid VAPID header for a new application server
+	authorization := func() string {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+
+		// The origin of requests created using httptest
+		token, err := vapid.NewToken("http://example.com", time.Now().Add(time.Hour), "", key)
+		require.NoError(t, err)
+
+		return vapid.FormatAuthorizationHeader(token, &key.PublicKey)
+	}
+
+	push := func(token string, authorization string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/push/"+token, nil)
+		request.Header.Set("TTL", "60")
+		request.Header.Set("Authorization", authorization)
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	key1 := authorization()
+	key2 := authorization()
+
+	assert.Equal(t, http.StatusCreated, push("a", key1).Code)
+
+	// Limited by subscription
+	recorder := push("a", key2)
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, "2", recorder.Header().Get("Retry-After"))
+
+	assert.Equal(t, http.StatusCreated, push("b", key1).Code)
+
+	// Limited by application server
+	recorder = push("c", key1)
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, "2", recorder.Header().Get("Retry-After"))
+
+	// Requests limited by subscription don't count against the application
+	// server
+	assert.Equal(t, http.StatusCreated, push("d", key2).Code)
+	assert.Equal(t, http.StatusCreated, push("e", key2).Code)
+
+	// Application servers without a valid VAPID header are limited as one,
+	// whatever key they claim
+	forgedKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	forged := "vapid t=token, k=" + base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), forgedKey.X, forgedKey.Y))
+
+	assert.Equal(t, http.StatusCreated, push("f", forged).Code)
+	assert.Equal(t, http.StatusCreated, push("g", "").Code)
+	assert.Equal(t, http.StatusTooManyRequests, push("h", forged).Code)
+}
@@ -1,6 +1,10 @@
 package webpush
 
-import "crypto/ecdh"
+import (
+	"crypto/ecdh"
+	"errors"
+	"time"
+)
 
 // Subscriber provides means to interact with a Web Push Push Service.
 // TODO: Should users that want to write a Push Service "server" implement this
@@ -13,16 +17,88 @@ type Subscriber interface {
 	// upstream push service. It is exposed for more advanced use cases, like a
 	// user agent / push service combo.
 	Subscribe(userAgentPrivateKey *ecdh.PrivateKey, applicationServerPublicKey *ecdh.PublicKey) (string, string, error)
+	// Unsubscribe tears down a subscription, meaning the push service will no
+	// longer accept push messages for it.
+	Unsubscribe(subscriptionID string) error
+}
+
+// ExpiringSubscriber is implemented by [Subscriber] implementations whose
+// subscriptions expire.
+type ExpiringSubscriber interface {
+	Subscriber
+	// ExpirationTime returns the time at which a subscription expires, or nil if
+	// it does not expire.
+	ExpirationTime(subscriptionID string) (*time.Time, error)
+}
+
+// AuthenticatingSubscriber is implemented by [Subscriber] implementations that
+// decrypt push messages themselves, such as push services keeping no state.
+// When implemented, it's used in place of [Subscriber.Subscribe].
+type AuthenticatingSubscriber interface {
+	Subscriber
+	// SubscribeWithAuthenticationSecret registers a subscription, like
+	// [Subscriber.Subscribe], given the subscription's authentication secret.
+	SubscribeWithAuthenticationSecret(userAgentPrivateKey *ecdh.PrivateKey, applicationServerPublicKey *ecdh.PublicKey, authenticationSecret []byte) (string, string, error)
+}
+
+// ReceivedMessage is an encrypted push message received by a [Subscriber].
+type ReceivedMessage struct {
+	SubscriptionID string
+	ContentType    string
+	Content        []byte
+}
+
+// MessageSubscriber is implemented by [Subscriber] implementations that
+// receive push messages themselves, such as clients of upstream push
+// services.
+type MessageSubscriber interface {
+	Subscriber
+	// OnPushMessage sets a handler to be invoked with each received push
+	// message. A non-nil error from the handler indicates that the message
+	// could not be handled. Errors wrapping [ErrDecryptionFailed] or
+	// [ErrSubscriptionNotFound] are permanent, the message should not be
+	// redelivered.
+	OnPushMessage(handler func(ReceivedMessage) error)
+}
+
+// ErrDecryptionFailed is returned when a received push message could not be
+// decrypted, such as when it's malformed or encrypted using the wrong keys.
+// A [Pusher] returning it has the push rejected with 400 Bad Request.
+var ErrDecryptionFailed = errors.New("decryption failed")
+
+// ErrNoListeners is returned when a received push message could not be
+// handled as there is no one listening for messages.
+var ErrNoListeners = errors.New("no listeners")
+
+// ChangingSubscriber is implemented by [Subscriber] implementations whose
+// subscriptions' endpoints may change, such as when an upstream push service
+// resets its state.
+type ChangingSubscriber interface {
+	Subscriber
+	// OnEndpointChange sets a handler to be invoked with the new endpoint each
+	// time the endpoint of a subscription changes.
+	OnEndpointChange(handler func(subscriptionID string, endpoint string))
 }
 
 type PushRequest struct {
-	Token       string
-	TTL         int
-	Topic       string
+	Token string
+	TTL   int
+	Topic string
+	// Urgency is the urgency of the message. Empty if not specified, which is
+	// equivalent to normal.
+	// SEE: https://datatracker.ietf.org/doc/html/rfc8030#section-5.3
+	Urgency     Urgency
 	ContentType string
-	Content     []byte
+	// ContentEncoding is the encoding of the content, "aes128gcm" for all
+	// messages with content.
+	ContentEncoding string
+	Content         []byte
 }
 
+// ErrDeliveryFailed is returned by a [Pusher] when a message could not be
+// delivered right now, but may be if the push is retried.
+var ErrDeliveryFailed = errors.New("delivery failed")
+
 type Pusher interface {
 	Push(request *PushRequest) error
 }
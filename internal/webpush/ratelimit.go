@@ -0,0 +1,134 @@
+package webpush
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimit configures a token bucket.
+type RateLimit struct {
+	// Rate is the number of requests replenished per second. A rate of zero or
+	// less disables rate limiting.
+	Rate float64
+	// Burst is the maximum number of requests allowed at once.
+	Burst int
+}
+
+// RateLimiter implements in-memory token bucket rate limiting, keyed by an
+// arbitrary string such as an application server's public key or a
+// subscription. It is safe for concurrent use.
+type RateLimiter struct {
+	mutex      sync.Mutex
+	limit      RateLimit
+	limits     map[string]RateLimit
+	buckets    map[string]*tokenBucket
+	lastPruned time.Time
+	now        func() time.Time
+}
+
+type tokenBucket struct {
+	limit   RateLimit
+	tokens  float64
+	updated time.Time
+}
+
+// NewRateLimiter creates a new [RateLimiter] applying limit to every key that
+// doesn't have a specific limit set using [RateLimiter.SetLimit].
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{
+		limit:   limit,
+		limits:  make(map[string]RateLimit),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// SetLimit sets the limit for a specific key, overriding the default limit.
+func (r *RateLimiter) SetLimit(key string, limit RateLimit) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.limits[key] = limit
+	delete(r.buckets, key)
+}
+
+// Allow consumes a token for key.
+// Returns whether or not the request is allowed and, if it's not, the time to
+// wait before a token is available.
+func (r *RateLimiter) Allow(key string) (bool, time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	limit, ok := r.limits[key]
+	if !ok {
+		limit = r.limit
+	}
+
+	// There's no sensible time to wait for a bucket that is never refilled
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+
+	now := r.now()
+	r.prune(now)
+
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{
+			limit:   limit,
+			tokens:  float64(limit.Burst),
+			updated: now,
+		}
+		r.buckets[key] = bucket
+	}
+
+	bucket.refill(now)
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - bucket.tokens) / bucket.limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+// Refund returns a token consumed by [RateLimiter.Allow] for key, such as when
+// a request is rejected for another reason.
+func (r *RateLimiter) Refund(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	bucket, ok := r.buckets[key]
+	if !ok {
+		return
+	}
+
+	bucket.tokens = min(float64(bucket.limit.Burst), bucket.tokens+1)
+}
+
+// prune removes buckets that have been refilled completely, as they are
+// indistinguishable from new buckets. Must be called with the mutex held.
+func (r *RateLimiter) prune(now time.Time) {
+	if now.Sub(r.lastPruned) < time.Minute {
+		return
+	}
+	r.lastPruned = now
+
+	for key, bucket := range r.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= float64(bucket.limit.Burst) {
+			delete(r.buckets, key)
+		}
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	b.tokens = min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+	b.updated = now
+}
@@ -0,0 +1,64 @@
+package webpush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+
+	limiter := NewRateLimiter(RateLimit{Rate: 1, Burst: 2})
+	limiter.now = func() time.Time { return now }
+
+	// Burst
+	ok, _ := limiter.Allow("a")
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("a")
+	assert.True(t, ok)
+
+	ok, wait := limiter.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 1*time.Second, wait)
+
+	// Keys are limited independently
+	ok, _ = limiter.Allow("b")
+	assert.True(t, ok)
+
+	// Tokens are replenished over time
+	now = now.Add(500 * time.Millisecond)
+	ok, wait = limiter.Allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = limiter.Allow("a")
+	assert.True(t, ok)
+
+	// Per-key limits override the default
+	limiter.SetLimit("c", RateLimit{Rate: 0.001, Burst: 1})
+	ok, _ = limiter.Allow("c")
+	assert.True(t, ok)
+	ok, wait = limiter.Allow("c")
+	assert.False(t, ok)
+	assert.Equal(t, 1000*time.Second, wait)
+
+	// Refunded tokens may be used again
+	limiter.Refund("c")
+	ok, _ = limiter.Allow("c")
+	assert.True(t, ok)
+
+	// A non-positive rate disables rate limiting
+	limiter.SetLimit("d", RateLimit{Rate: 0, Burst: 0})
+	for range 3 {
+		ok, _ = limiter.Allow("d")
+		assert.True(t, ok)
+	}
+
+	// Full buckets are pruned
+	now = now.Add(2 * time.Minute)
+	limiter.Allow("a")
+	assert.Len(t, limiter.buckets, 2)
+}
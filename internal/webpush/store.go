@@ -0,0 +1,358 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrSubscriptionNotFound is returned when a subscription is not known.
+var ErrSubscriptionNotFound = errors.New("unknown subscription")
+
+// SubscriptionStore stores subscriptions, including their private keys.
+// Implementations must be safe for concurrent use.
+type SubscriptionStore interface {
+	// Get returns a subscription.
+	// Returns [ErrSubscriptionNotFound] if the subscription does not exist.
+	Get(id string) (*Subscription, error)
+	// Put stores a subscription, replacing any existing subscription with the
+	// same ID.
+	Put(subscription *Subscription) error
+	// Delete removes a subscription.
+	// Returns [ErrSubscriptionNotFound] if the subscription does not exist.
+	Delete(id string) error
+	// List returns all subscriptions.
+	List() ([]*Subscription, error)
+}
+
+var _ SubscriptionStore = (*MemorySubscriptionStore)(nil)
+
+// MemorySubscriptionStore is a [SubscriptionStore] keeping subscriptions in
+// memory.
+type MemorySubscriptionStore struct {
+	mutex         sync.RWMutex
+	subscriptions map[string]*Subscription
+}
+
+func NewMemorySubscriptionStore() *MemorySubscriptionStore {
+	return &MemorySubscriptionStore{
+		subscriptions: make(map[string]*Subscription),
+	}
+}
+
+// Get implements SubscriptionStore.
+func (s *MemorySubscriptionStore) Get(id string) (*Subscription, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	subscription, ok := s.subscriptions[id]
+	if !ok {
+		return nil, ErrSubscriptionNotFound
+	}
+
+	return subscription, nil
+}
+
+// Put implements SubscriptionStore.
+func (s *MemorySubscriptionStore) Put(subscription *Subscription) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.subscriptions[subscription.ID] = subscription
+	return nil
+}
+
+// Delete implements SubscriptionStore.
+func (s *MemorySubscriptionStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.subscriptions[id]; !ok {
+		return ErrSubscriptionNotFound
+	}
+
+	delete(s.subscriptions, id)
+	return nil
+}
+
+// List implements SubscriptionStore.
+func (s *MemorySubscriptionStore) List() ([]*Subscription, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	subscriptions := make([]*Subscription, 0, len(s.subscriptions))
+	for _, subscription := range s.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	return subscriptions, nil
+}
+
+var _ SubscriptionStore = (*FileSubscriptionStore)(nil)
+
+// FileSubscriptionStore is a [SubscriptionStore] persisting subscriptions to a
+// JSON file. Subscriptions are kept in memory and the file is rewritten on
+// each change.
+// User agent private keys are encrypted at rest using AES-256-GCM with a key
+// derived from a passphrase.
+type FileSubscriptionStore struct {
+	path string
+	salt []byte
+	key  []byte
+
+	memory *MemorySubscriptionStore
+	// mutex serializes writes to the file.
+	mutex sync.Mutex
+}
+
+// fileStoreKeyIterations is the number of PBKDF2-HMAC-SHA256 iterations used
+// to derive the encryption key from the passphrase.
+// SEE: https://cheatsheetseries.owasp.org/cheatsheets/Password_Storage_Cheat_Sheet.html#pbkdf2
+const fileStoreKeyIterations = 600_000
+
+type fileStore struct {
+	Version       int                     `json:"version"`
+	Salt          string                  `json:"salt"`
+	Subscriptions []fileStoreSubscription `json:"subscriptions"`
+}
+
+type fileStoreSubscription struct {
+	ID                         string           `json:"id"`
+	Endpoint                   string           `json:"endpoint"`
+	ExpirationTime             *time.Time       `json:"expirationTime,omitempty"`
+	Keys                       SubscriptionKeys `json:"keys"`
+	ApplicationServerPublicKey string           `json:"applicationServerPublicKey"`
+	// UserAgentPrivateKey is the sealed private key (ciphertext || nonce).
+	UserAgentPrivateKey string `json:"userAgentPrivateKey"`
+}
+
+// NewFileSubscriptionStore opens or creates a store at path. Returns an error
+// if an existing store cannot be decrypted using passphrase.
+func NewFileSubscriptionStore(path string, passphrase string) (*FileSubscriptionStore, error) {
+	store := &FileSubscriptionStore{
+		path:   path,
+		memory: NewMemorySubscriptionStore(),
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		store.salt = make([]byte, 16)
+		if _, err := rand.Read(store.salt); err != nil {
+			return nil, err
+		}
+
+		store.key, err = pbkdf2.Key(sha256.New, passphrase, store.salt, fileStoreKeyIterations, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var file fileStore
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+
+	if file.Version != 1 {
+		return nil, fmt.Errorf("unsupported store version")
+	}
+
+	store.salt, err = base64.RawURLEncoding.DecodeString(file.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	store.key, err = pbkdf2.Key(sha256.New, passphrase, store.salt, fileStoreKeyIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range file.Subscriptions {
+		subscription, err := store.open(&entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open subscription %s: %w", entry.ID, err)
+		}
+
+		store.memory.Put(subscription)
+	}
+
+	return store, nil
+}
+
+// Get implements SubscriptionStore.
+func (s *FileSubscriptionStore) Get(id string) (*Subscription, error) {
+	return s.memory.Get(id)
+}
+
+// Put implements SubscriptionStore.
+func (s *FileSubscriptionStore) Put(subscription *Subscription) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.memory.Put(subscription); err != nil {
+		return err
+	}
+
+	return s.write()
+}
+
+// Delete implements SubscriptionStore.
+func (s *FileSubscriptionStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.memory.Delete(id); err != nil {
+		return err
+	}
+
+	return s.write()
+}
+
+// List implements SubscriptionStore.
+func (s *FileSubscriptionStore) List() ([]*Subscription, error) {
+	return s.memory.List()
+}
+
+// write writes all subscriptions to disk. Must be called with the mutex held.
+func (s *FileSubscriptionStore) write() error {
+	subscriptions, err := s.memory.List()
+	if err != nil {
+		return err
+	}
+
+	file := fileStore{
+		Version:       1,
+		Salt:          base64.RawURLEncoding.EncodeToString(s.salt),
+		Subscriptions: make([]fileStoreSubscription, 0, len(subscriptions)),
+	}
+
+	for _, subscription := range subscriptions {
+		entry, err := s.seal(subscription)
+		if err != nil {
+			return err
+		}
+
+		file.Subscriptions = append(file.Subscriptions, *entry)
+	}
+
+	content, err := json.MarshalIndent(&file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it to not leave a partially written
+	// store behind
+	temp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(content); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), s.path)
+}
+
+func (s *FileSubscriptionStore) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (s *FileSubscriptionStore) seal(subscription *Subscription) (*fileStoreSubscription, error) {
+	aead, err := s.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	// Bind the key to the subscription
+	sealed := aead.Seal(nil, nonce, subscription.userAgentPrivateKey.Bytes(), []byte(subscription.ID))
+	sealed = append(sealed, nonce...)
+
+	return &fileStoreSubscription{
+		ID:                         subscription.ID,
+		Endpoint:                   subscription.Endpoint,
+		ExpirationTime:             subscription.ExpirationTime,
+		Keys:                       subscription.Keys,
+		ApplicationServerPublicKey: base64.RawURLEncoding.EncodeToString(subscription.applicationServerPublicKey.Bytes()),
+		UserAgentPrivateKey:        base64.RawURLEncoding.EncodeToString(sealed),
+	}, nil
+}
+
+func (s *FileSubscriptionStore) open(entry *fileStoreSubscription) (*Subscription, error) {
+	aead, err := s.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(entry.UserAgentPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid private key")
+	}
+
+	nonce := sealed[len(sealed)-aead.NonceSize():]
+	ciphertext := sealed[:len(sealed)-aead.NonceSize()]
+
+	userAgentPrivateKeyBytes, err := aead.Open(nil, nonce, ciphertext, []byte(entry.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	userAgentPrivateKey, err := ecdh.P256().NewPrivateKey(userAgentPrivateKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	applicationServerPublicKeyBytes, err := base64.RawURLEncoding.DecodeString(entry.ApplicationServerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	applicationServerPublicKey, err := ecdh.P256().NewPublicKey(applicationServerPublicKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Subscription{
+		ID:             entry.ID,
+		Endpoint:       entry.Endpoint,
+		ExpirationTime: entry.ExpirationTime,
+		Keys:           entry.Keys,
+
+		applicationServerPublicKey: applicationServerPublicKey,
+		userAgentPrivateKey:        userAgentPrivateKey,
+	}, nil
+}
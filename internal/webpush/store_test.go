@@ -0,0 +1,65 @@
+package webpush
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSubscriptionStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subscriptions.json")
+
+	userAgentPrivateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	applicationServerPrivateKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	subscription := &Subscription{
+		ID:       "597cd1af-0686-47ba-959f-c6d7b49149b2",
+		Endpoint: "https://example.com/push/token",
+		Keys: SubscriptionKeys{
+			Auth:   "uEMWDVY9OhnL-QwUZlKNRg",
+			P256DH: "BAgmPAlNFAEASIyxob47Ov6ftM2f1Cb6WR60zKP5UZSA9ah507JHtsUA0GsOxkMo6KUgwHc1pU7Gj5UlSESITTg",
+		},
+
+		applicationServerPublicKey: applicationServerPrivateKey.PublicKey(),
+		userAgentPrivateKey:        userAgentPrivateKey,
+	}
+
+	store, err := NewFileSubscriptionStore(path, "passphrase")
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put(subscription))
+
+	// The private key is not stored in plaintext
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), base64.RawURLEncoding.EncodeToString(userAgentPrivateKey.Bytes()))
+
+	// Subscriptions survive reopening the store
+	store, err = NewFileSubscriptionStore(path, "passphrase")
+	require.NoError(t, err)
+
+	actualSubscription, err := store.Get(subscription.ID)
+	require.NoError(t, err)
+	assert.Equal(t, subscription, actualSubscription)
+
+	// The store cannot be opened using another passphrase
+	_, err = NewFileSubscriptionStore(path, "wrong passphrase")
+	assert.Error(t, err)
+
+	require.NoError(t, store.Delete(subscription.ID))
+
+	store, err = NewFileSubscriptionStore(path, "passphrase")
+	require.NoError(t, err)
+
+	_, err = store.Get(subscription.ID)
+	assert.ErrorIs(t, err, ErrSubscriptionNotFound)
+}